@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Argument templates for the per-cycle smartctl call of each device class.
+// {device} is replaced with the device path and {type} with its -d type. -i
+// refreshes the drive's identity from the same call.
+var collectArgs = map[string]string{
+	"sat":      "-i -A -H -d {type} --json=c {device}",
+	"nvme":     "-i -A -H -d nvme --json=c {device}",
+	"scsi":     "-i -A -H -d scsi --json=c {device}",
+	"megaraid": "-i -A -H -d {type} --json=c {device}",
+	"aacraid":  "-i -A -H -d {type} --json=c {device}",
+	"areca":    "-i -A -H -d {type} --json=c {device}",
+	"3ware":    "-i -A -H -d {type} --json=c {device}",
+	"cciss":    "-i -A -H -d {type} --json=c {device}",
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{[^}]*\}`)
+
+// setCollectArgs parses a --collect-args value of the form class=template and
+// validates the template's placeholders.
+func setCollectArgs(value string) error {
+	class, template, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid --collect-args %q, expected class=template", value)
+	}
+	if _, known := collectArgs[class]; !known {
+		return fmt.Errorf("invalid --collect-args %q, unknown device class %q", value, class)
+	}
+	for _, placeholder := range placeholderRegexp.FindAllString(template, -1) {
+		if placeholder != "{device}" && placeholder != "{type}" {
+			return fmt.Errorf("invalid --collect-args %q, unknown placeholder %s", value, placeholder)
+		}
+	}
+	if !strings.Contains(template, "{device}") {
+		return fmt.Errorf("invalid --collect-args %q, missing {device} placeholder", value)
+	}
+	if !strings.Contains(template, "--json") {
+		return fmt.Errorf("invalid --collect-args %q, smartctl output must be JSON", value)
+	}
+	collectArgs[class] = template
+	return nil
+}
+
+// deviceCollectArgs returns the arguments of the per-cycle smartctl call for a
+// device, or nil for a device of unknown type.
+func deviceCollectArgs(device *Device) []string {
+	switch {
+	case device.ControllerID != "":
+		return collectCommandArgs(device.Controller, device.BusDevice, device.ControllerID)
+	case matchesType(satTypes, device.Type):
+		return collectCommandArgs("sat", device.BusDevice, device.Type)
+	case matchesType(nvmeTypes, device.Type):
+		return collectCommandArgs("nvme", device.BusDevice, "nvme")
+	case matchesType(scsiTypes, device.Type):
+		return collectCommandArgs("scsi", device.BusDevice, "scsi")
+	}
+	return nil
+}
+
+// collectCommandArgs expands the argument template of a device class.
+func collectCommandArgs(class, dev, typ string) []string {
+	replacer := strings.NewReplacer("{device}", dev, "{type}", typ)
+	args := strings.Fields(collectArgs[class])
+	for i, arg := range args {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
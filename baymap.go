@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadBayMap reads a --bay-map-file. Each non-empty line holds a drive serial
+// number or WWN followed by the bay identifier, separated by whitespace. Lines
+// starting with # are comments.
+func loadBayMap(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bays := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<serial or wwn> <bay>\", got %q", path, lineNo, line)
+		}
+		bays[normalizeBayKey(fields[0])] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return bays, nil
+}
+
+// normalizeBayKey makes WWNs match regardless of case or a 0x prefix.
+func normalizeBayKey(key string) string {
+	return strings.TrimPrefix(strings.ToLower(key), "0x")
+}
+
+// lookupBay returns the bay of a device by serial number, then by WWN.
+func lookupBay(device *Device) string {
+	if bay, ok := bayMap[normalizeBayKey(device.SerialNumber)]; ok && device.SerialNumber != "" {
+		return bay
+	}
+	if bay, ok := bayMap[normalizeBayKey(device.WWN)]; ok && device.WWN != "" {
+		return bay
+	}
+	return ""
+}
+
+// formatWWN renders smartctl's split WWN fields as a single hex string, e.g.
+// 5000c500a1b2c3d4.
+func formatWWN(naa, oui, id uint64) string {
+	if naa == 0 && oui == 0 && id == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x%06x%09x", naa, oui, id)
+}
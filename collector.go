@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registry holds every metric served on /metrics.
+var registry = prometheus.NewRegistry()
+
+// metricPrefix replaces the smartctl prefix of the device metrics, set from
+// --metric-prefix. The samples keep their smartctl_ names until exported.
+var metricPrefix = "smartctl"
+
+// metricSample is one value read from a device during a collection.
+type metricSample struct {
+	Name   string
+	Labels prometheus.Labels
+	Value  float64
+}
+
+// deviceGeneration changes whenever rescan adds or removes devices, which
+// invalidates the cached samples.
+var deviceGeneration atomic.Int64
+
+// smartCollector reads SMART data when scraped, so that every scrape returns
+// the drives present right now and series of removed drives disappear. The
+// result is cached for ttl to keep frequent scrapes from hammering the drives.
+type smartCollector struct {
+	ttl time.Duration
+
+	mu          sync.Mutex
+	lastCollect time.Time
+	generation  int64
+	samples     []metricSample
+}
+
+func newSmartCollector(ttl time.Duration) *smartCollector {
+	return &smartCollector{ttl: ttl}
+}
+
+// collectCycle runs collect and sets smartctl_exporter_up to whether the cycle
+// completed with smartctl available. A panic in the cycle is logged and leaves
+// only the exporter's own metrics for the scrape, rather than killing it. A
+// panic reading one device only marks that device down.
+func collectCycle() (samples []metricSample, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Collection cycle panicked", "panic", r, "stack", string(debug.Stack()))
+			exporterUp.Set(0)
+			samples, ok = nil, false
+		}
+	}()
+	samples, completed := collect()
+	if !completed {
+		exporterUp.Set(0)
+		return samples, false
+	}
+	if inputDir == "" {
+		if _, err := exec.LookPath(smartctlPath); err != nil {
+			slog.Error("smartctl binary is no longer available", "path", smartctlPath, "err", err)
+			exporterUp.Set(0)
+			return samples, true
+		}
+	}
+	exporterUp.Set(1)
+	return samples, true
+}
+
+// Describe sends no descriptors. The metrics depend on what the drives report,
+// which makes this an unchecked collector.
+func (c *smartCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// refresh runs a collection cycle unless the cached samples are still fresh,
+// and returns the samples.
+func (c *smartCollector) refresh() []metricSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	generation := deviceGeneration.Load()
+	if c.lastCollect.IsZero() || time.Since(c.lastCollect) >= c.ttl || generation != c.generation {
+		var ok bool
+		c.samples, ok = collectCycle()
+		c.lastCollect = time.Now()
+		c.generation = generation
+		if ok {
+			ready.Store(true)
+		}
+	}
+	return c.samples
+}
+
+func (c *smartCollector) Collect(ch chan<- prometheus.Metric) {
+	samples := c.refresh()
+
+	seen := make(map[string]bool)
+	labelNames := make(map[string]string)
+	for _, sample := range samples {
+		if sample.Name == "" {
+			metricRegistrationErrors.Inc()
+			slog.Debug("Skipping metric without a valid name", "labels", sample.Labels)
+			continue
+		}
+		names := make([]string, 0, len(sample.Labels))
+		for name := range sample.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = sample.Labels[name]
+		}
+
+		// Attribute names that differ only in spelling sanitize to the same
+		// metric, keep the first
+		key := sample.Name + "\xff" + strings.Join(values, "\xff")
+		if seen[key] {
+			metricRegistrationErrors.Inc()
+			slog.Debug("Skipping duplicate metric", "metric", sample.Name, "labels", sample.Labels)
+			continue
+		}
+		seen[key] = true
+
+		// The registry fails the whole scrape on a metric whose label names
+		// differ between series, keep the first label set
+		joined := strings.Join(names, ",")
+		if first, ok := labelNames[sample.Name]; !ok {
+			labelNames[sample.Name] = joined
+		} else if first != joined {
+			metricRegistrationErrors.Inc()
+			slog.Warn("Skipping metric with inconsistent labels", "metric", sample.Name, "labels", joined, "expected", first)
+			continue
+		}
+
+		valueType := prometheus.GaugeValue
+		name := metricPrefix + strings.TrimPrefix(sample.Name, "smartctl")
+		// Counters need the _total suffix in OpenMetrics and for promtool
+		if counterTypes && contains(counterMetrics, sample.Name) {
+			valueType = prometheus.CounterValue
+			name += "_total"
+		}
+		desc := prometheus.NewDesc(name, metricHelp(sample.Name), names, nil)
+		metric, err := prometheus.NewConstMetric(desc, valueType, sample.Value, values...)
+		if err != nil {
+			metricRegistrationErrors.Inc()
+			slog.Warn("Skipping metric", "metric", name, "err", err)
+			continue
+		}
+		ch <- metric
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// cachedCollector returns a collector that serves samples without running
+// smartctl.
+func cachedCollector(samples []metricSample) *smartCollector {
+	return &smartCollector{
+		ttl:         time.Hour,
+		samples:     samples,
+		lastCollect: time.Now(),
+		generation:  deviceGeneration.Load(),
+	}
+}
+
+// gatherTypes registers collector in a new registry and returns the type of
+// every metric family it exposes.
+func gatherTypes(t *testing.T, collector prometheus.Collector) map[string]dto.MetricType {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+	types := make(map[string]dto.MetricType)
+	for _, family := range families {
+		types[family.GetName()] = family.GetType()
+	}
+	return types
+}
+
+func TestCollectCounterTypes(t *testing.T) {
+	labels := prometheus.Labels{"device": "sda"}
+	collector := cachedCollector([]metricSample{
+		{Name: "smartctl_device_power_on_hours", Labels: labels, Value: 12345},
+		{Name: "smartctl_power_on_hours", Labels: labels, Value: 98},
+		{Name: "smartctl_temperature_celsius", Labels: labels, Value: 35},
+	})
+
+	counterTypes = true
+	defer func() { counterTypes = false }()
+	want := map[string]dto.MetricType{
+		"smartctl_device_power_on_hours_total": dto.MetricType_COUNTER,
+		"smartctl_power_on_hours":              dto.MetricType_GAUGE,
+		"smartctl_temperature_celsius":         dto.MetricType_GAUGE,
+	}
+	got := gatherTypes(t, collector)
+	if len(got) != len(want) {
+		t.Errorf("got metrics %v, want %v", got, want)
+	}
+	for name, typ := range want {
+		if got[name] != typ {
+			t.Errorf("%s: got type %v, want %v", name, got[name], typ)
+		}
+	}
+
+	counterTypes = false
+	got = gatherTypes(t, collector)
+	if got["smartctl_device_power_on_hours"] != dto.MetricType_GAUGE {
+		t.Errorf("default: got metrics %v, want gauge smartctl_device_power_on_hours", got)
+	}
+}
+
+func TestCounterMetricsAreMonotonic(t *testing.T) {
+	// Normalized ATA values count down as the drive ages
+	for _, name := range []string{"smartctl_power_on_hours", "smartctl_power_cycles", "smartctl_power_cycle_count"} {
+		if contains(counterMetrics, name) {
+			t.Errorf("counterMetrics lists %s, which is a normalized ATA value", name)
+		}
+	}
+}
+
+// panicRunner panics on every call, like a parser bug would.
+type panicRunner struct{}
+
+func (panicRunner) Run(args []string) ([]byte, int, error) {
+	panic("unexpected smartctl output")
+}
+
+func TestCollectCycleWorkerPanic(t *testing.T) {
+	useRunners(t, panicRunner{}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{
+		"/dev/sda": {Name: "/dev/sda", BusDevice: "/dev/sda", Type: "sat"},
+	}
+	t.Cleanup(func() { devices = savedDevices })
+	exporterUp.Set(1)
+
+	samples, ok := collectCycle()
+	if ok {
+		t.Error("collectCycle() reported success after a worker panicked")
+	}
+	if got := testGaugeValue(t, exporterUp); got != 0 {
+		t.Errorf("smartctl_exporter_up = %v, want 0", got)
+	}
+	found := false
+	for _, sample := range samples {
+		if sample.Name == "smartctl_device_up" && sample.Labels["drive"] == "_dev_sda" {
+			found = true
+			if sample.Value != 0 {
+				t.Errorf("smartctl_device_up = %v, want 0", sample.Value)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no smartctl_device_up for the device, got %v", samples)
+	}
+	var reasons []string
+	for _, sample := range samples {
+		if sample.Name == "smartctl_device_down_reason" && sample.Labels["drive"] == "_dev_sda" {
+			reasons = append(reasons, sample.Labels["reason"])
+		}
+	}
+	if len(reasons) != 1 || reasons[0] != "panic" {
+		t.Errorf("smartctl_device_down_reason reasons = %v, want [panic]", reasons)
+	}
+}
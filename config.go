@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig holds the settings that can be read from --config-file. Flags and
+// environment variables take precedence over it.
+type fileConfig struct {
+	Address        string   `yaml:"address"`
+	Port           string   `yaml:"port"`
+	Interval       *int     `yaml:"interval"`
+	SmartctlPath   string   `yaml:"smartctl_path"`
+	IncludeDevices []string `yaml:"include_devices"`
+	ExcludeDevices []string `yaml:"exclude_devices"`
+	Devices        []string `yaml:"devices"`
+}
+
+// loadConfig reads a YAML --config-file. Unknown keys are an error, so that a
+// misspelled setting doesn't go unnoticed.
+func loadConfig(path string) (*fileConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config fileConfig
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &config, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "regexp"
+
+// controllerType is a family of RAID controllers or HBAs whose disks smartctl
+// reaches through the controller's bus device, with a -d type selecting the
+// disk. The scan lists one entry per disk, such as /dev/bus/0 -d megaraid,5.
+type controllerType struct {
+	name string
+	// re matches device types of the family and captures the -d argument
+	// selecting the disk
+	re *regexp.Regexp
+}
+
+// controllerTypes are the supported controller families. Adding one takes its
+// -d syntax here and a --collect-args class of the same name. The patterns
+// aren't anchored, so that a protocol prefix such as the sat+ of
+// sat+megaraid,N is dropped from the -d argument: some smartctl versions
+// reject it, and smartctl detects SATA disks behind the controller by itself.
+var controllerTypes = []controllerType{
+	{"megaraid", regexp.MustCompile(`megaraid,\d+`)},
+	{"aacraid", regexp.MustCompile(`aacraid,\d+,\d+,\d+`)},
+	{"areca", regexp.MustCompile(`areca,\d+(/\d+)?`)},
+	{"3ware", regexp.MustCompile(`3ware,\d+`)},
+	{"cciss", regexp.MustCompile(`cciss,\d+`)},
+}
+
+// controllerDeviceID returns the controller family of a device type and the
+// -d argument selecting the disk behind it. Both are "" for devices that
+// aren't behind a supported controller.
+func controllerDeviceID(typ string) (string, string) {
+	for _, controller := range controllerTypes {
+		if id := controller.re.FindString(typ); id != "" {
+			return controller.name, id
+		}
+	}
+	return "", ""
+}
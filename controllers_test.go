@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestControllerDeviceID(t *testing.T) {
+	tests := []struct {
+		typ        string
+		controller string
+		id         string
+	}{
+		{"megaraid,5", "megaraid", "megaraid,5"},
+		{"sat+megaraid,5", "megaraid", "megaraid,5"},
+		{"megaraid,12", "megaraid", "megaraid,12"},
+		{"sat+megaraid,0", "megaraid", "megaraid,0"},
+		{"areca,3/1", "areca", "areca,3/1"},
+		{"sat", "", ""},
+		{"nvme", "", ""},
+		{"megaraid", "", ""},
+	}
+	for _, tt := range tests {
+		controller, id := controllerDeviceID(tt.typ)
+		if controller != tt.controller || id != tt.id {
+			t.Errorf("controllerDeviceID(%q) = %q, %q, want %q, %q", tt.typ, controller, id, tt.controller, tt.id)
+		}
+	}
+}
+
+func TestControllerCommandDeviceArg(t *testing.T) {
+	// Both forms probe the disk with -d megaraid,N
+	for _, typ := range []string{"megaraid,5", "sat+megaraid,5"} {
+		_, id := controllerDeviceID(typ)
+		args := collectCommandArgs("megaraid", "/dev/bus/0", id)
+		var deviceType string
+		for i, arg := range args[:len(args)-1] {
+			if arg == "-d" {
+				deviceType = args[i+1]
+			}
+		}
+		if deviceType != "megaraid,5" {
+			t.Errorf("%s: collect command %q passes -d %q, want megaraid,5", typ, args, deviceType)
+		}
+		if got := commandDrive(args); got != "_dev_bus_0_megaraid_5" {
+			t.Errorf("%s: commandDrive() = %q, want %q", typ, got, "_dev_bus_0_megaraid_5")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// deviceCoverage records which smartctl JSON fields of a device were seen and
+// which became metrics, for the /debug/coverage endpoint.
+type deviceCoverage struct {
+	Seen     []string       `json:"seen"`
+	Exported []string       `json:"exported"`
+	Dropped  []droppedField `json:"dropped"`
+	seen     map[string]bool
+}
+
+type droppedField struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+var (
+	debugCoverage bool
+	// Coverage of the last collection per drive
+	coverage = make(map[string]*deviceCoverage)
+)
+
+// record walks raw smartctl output, noting every leaf field and the ones that
+// can't become a metric because they aren't numeric. A nil coverage, as used
+// when --debug-coverage is off, records nothing.
+func (c *deviceCoverage) record(output []byte) {
+	if c == nil {
+		return
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(output, &data); err != nil {
+		return
+	}
+	c.walk("", data)
+}
+
+func (c *deviceCoverage) walk(prefix string, data map[string]interface{}) {
+	for key, value := range data {
+		fullKey := key
+		if prefix != "" {
+			fullKey = prefix + "_" + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			c.walk(fullKey, v)
+			continue
+		case []interface{}:
+			// Elements are keyed by index, as parseArray does
+			for i, elem := range v {
+				c.walk(fullKey, map[string]interface{}{strconv.Itoa(i): elem})
+			}
+			continue
+		case string:
+			c.Dropped = append(c.Dropped, droppedField{Key: fullKey, Type: "string"})
+		case nil:
+			c.Dropped = append(c.Dropped, droppedField{Key: fullKey, Type: "null"})
+		}
+		if !c.seen[fullKey] {
+			c.seen[fullKey] = true
+			c.Seen = append(c.Seen, fullKey)
+		}
+	}
+}
+
+func newDeviceCoverage() *deviceCoverage {
+	return &deviceCoverage{seen: make(map[string]bool)}
+}
+
+// finish records the exported attributes and sorts the report.
+func (c *deviceCoverage) finish(attrs map[string]float64, labeled []labeledValue) {
+	exported := make(map[string]bool)
+	for key := range attrs {
+		exported[key] = true
+	}
+	for _, lv := range labeled {
+		exported[lv.Name] = true
+	}
+	for key := range exported {
+		c.Exported = append(c.Exported, key)
+	}
+	sort.Strings(c.Seen)
+	sort.Strings(c.Exported)
+	sort.Slice(c.Dropped, func(i, j int) bool { return c.Dropped[i].Key < c.Dropped[j].Key })
+}
+
+// coverageHandler serves /debug/coverage.
+func coverageHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(coverage); err != nil {
+		slog.Error("Error writing coverage report", "err", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// devicePattern matches device names from --include-device and
+// --exclude-device. Patterns are shell globs, or regular expressions when
+// prefixed with "regex:".
+type devicePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+var (
+	includeDevices []devicePattern
+	excludeDevices []devicePattern
+)
+
+func parseDevicePattern(value string) (devicePattern, error) {
+	if strings.HasPrefix(value, "regex:") {
+		expr := strings.TrimPrefix(value, "regex:")
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return devicePattern{}, fmt.Errorf("invalid device regex %q: %v", expr, err)
+		}
+		return devicePattern{re: re}, nil
+	}
+	if _, err := filepath.Match(value, ""); err != nil {
+		return devicePattern{}, fmt.Errorf("invalid device glob %q: %v", value, err)
+	}
+	return devicePattern{glob: value}, nil
+}
+
+func (p devicePattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	matched, _ := filepath.Match(p.glob, name)
+	return matched
+}
+
+// deviceIncluded reports whether a scanned device should be probed. Without
+// --include-device every device is included; --exclude-device wins over it.
+func deviceIncluded(name string) bool {
+	for _, p := range excludeDevices {
+		if p.match(name) {
+			return false
+		}
+	}
+	if len(includeDevices) == 0 {
+		return true
+	}
+	for _, p := range includeDevices {
+		if p.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
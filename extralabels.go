@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// extraLabels are the --label values, added to every exported series.
+var extraLabels = prometheus.Labels{}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// deviceLabelNames are the labels identifying a drive, which a --label can't
+// override.
+var deviceLabelNames = []string{"drive", "bay", "type", "model_family", "model_name", "serial_number", "firmware_version", "media_type", "namespace", "bus_device", "controller_id"}
+
+// metricLabelNames are the labels of individual metrics, such as the id of
+// smartctl_ata_attribute or the reason of smartctl_device_skipped_total. The
+// registry rejects a --label of the same name on every series of the metric.
+var metricLabelNames = []string{
+	"id", "name", "bit", "sensor", "counter", "error_type", "operation", "reason", "error",
+	"controller", "command", "version", "go_version", "smartctl_version",
+}
+
+// addExtraLabel parses a --label value of the form key=value.
+func addExtraLabel(value string) error {
+	name, labelValue, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid --label %q, expected key=value", value)
+	}
+	if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid --label %q, %q isn't a valid label name", value, name)
+	}
+	if contains(deviceLabelNames, name) || contains(metricLabelNames, name) {
+		return fmt.Errorf("invalid --label %q, the exporter sets the %s label itself", value, name)
+	}
+	extraLabels[name] = labelValue
+	return nil
+}
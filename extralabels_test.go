@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddExtraLabel(t *testing.T) {
+	t.Cleanup(func() { extraLabels = map[string]string{} })
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"datacenter=eu1", true},
+		{"rack=", true},
+		{"datacenter", false},
+		{"1rack=a", false},
+		{"__name__=x", false},
+		// Set by the exporter on the drive, or on single metrics
+		{"drive=x", false},
+		{"serial_number=x", false},
+		{"name=x", false},
+		{"id=5", false},
+		{"reason=x", false},
+		{"sensor=1", false},
+		{"controller=x", false},
+		{"command=x", false},
+		{"version=1", false},
+	}
+	for _, tt := range tests {
+		err := addExtraLabel(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("addExtraLabel(%q) = %v, want ok %v", tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestExtraLabelsRejectEmittedLabels(t *testing.T) {
+	t.Cleanup(func() { extraLabels = map[string]string{} })
+	sda := &Device{Name: "/dev/sda", BusDevice: "/dev/sda", Type: "sat", ModelName: "ST4000NM0035", SerialNumber: "ZC1"}
+	useRunners(t, fakeRunner{
+		strings.Join(collectCommandArgs("sat", "/dev/sda", "sat"), " "): `{"smart_status":{"passed":true},
+			"ata_smart_attributes":{"table":[{"id":5,"name":"Reallocated_Sector_Ct","value":100,"worst":100,"thresh":10,"raw":{"value":3,"string":"3"}}]}}`,
+	}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{sda.Name: sda}
+	t.Cleanup(func() { devices = savedDevices })
+
+	samples, _ := collect()
+	if len(samples) == 0 {
+		t.Fatal("collect() returned no samples")
+	}
+	for _, sample := range samples {
+		for name := range sample.Labels {
+			if err := addExtraLabel(name + "=x"); err == nil {
+				t.Errorf("--label %s=x accepted, but %s has the label", name, sample.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// authToken is the bearer token required on every endpoint, empty to leave the
+// exporter unauthenticated.
+var authToken string
+
+// requireToken rejects requests without an "Authorization: Bearer" header
+// matching --auth-token.
+func requireToken(next http.Handler) http.Handler {
+	if authToken == "" {
+		return next
+	}
+	expected := []byte("Bearer " + authToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsHandler serves the metrics of gatherer on /metrics.
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		// Serve what could be gathered rather than failing the scrape
+		ErrorLog:      slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+		ErrorHandling: promhttp.ContinueOnError,
+		// Scrapers asking for OpenMetrics get it, others the text format
+		EnableOpenMetrics: true,
+	})
+}
+
+// ready is set once the first collection cycle completed and /metrics serves
+// device metrics.
+var ready atomic.Bool
+
+// healthzHandler serves /healthz, which succeeds as long as the server is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler serves /readyz, which fails until the first collection cycle
+// completed.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "waiting for the first collection", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// findDevice returns the device with the given name or drive label, or nil.
+func findDevice(name string) *Device {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, device := range devices {
+		if device.Name == name || sanitizeLabelValue(device.Name) == name {
+			return device
+		}
+	}
+	return nil
+}
+
+// debugSmartctl enables /debug/smartctl.
+var debugSmartctl bool
+
+// smartctlHandler serves /debug/smartctl?device=/dev/sda with the raw output of
+// the smartctl call the exporter runs for the device each cycle, so that it can
+// be attached to bug reports. The device is its name or drive label.
+func smartctlHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("device")
+	if name == "" {
+		http.Error(w, "missing device parameter", http.StatusBadRequest)
+		return
+	}
+
+	device := findDevice(name)
+	if device == nil {
+		http.Error(w, "no device "+name, http.StatusNotFound)
+		return
+	}
+	args := deviceCollectArgs(device)
+	if args == nil {
+		http.Error(w, "unknown type "+device.Type+" of device "+name, http.StatusNotFound)
+		return
+	}
+
+	run := runSmartctlCmd
+	if device.ControllerID != "" {
+		run = runControllerCmd
+	}
+	// smartctl's exit status is a bitmask, only a failure to run or a kill is
+	// an error here
+	output, exitCode, err := run(args)
+	if err != nil && exitCode <= 0 {
+		http.Error(w, "error running smartctl: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Smartctl-Args", strings.Join(args, " "))
+	w.Header().Set("X-Smartctl-Exit-Code", strconv.Itoa(exitCode))
+	w.Write(output)
+}
+
+// deviceHandler serves /device?serial=XXXX with the metrics of the device with
+// that serial number. Unlike the device path, the serial survives reboots and
+// re-cabling.
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	serial := r.URL.Query().Get("serial")
+	if serial == "" {
+		http.Error(w, "missing serial parameter", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	drive := ""
+	for _, device := range devices {
+		if device.SerialNumber == serial {
+			drive = sanitizeLabelValue(device.Name)
+			break
+		}
+	}
+	mutex.Unlock()
+
+	if drive == "" {
+		http.Error(w, "no device with serial "+serial, http.StatusNotFound)
+		return
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		http.Error(w, "error gathering metrics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	encoder := expfmt.NewEncoder(w, format)
+	for _, family := range filterByLabel(families, "drive", drive) {
+		if err := encoder.Encode(family); err != nil {
+			slog.Error("Error encoding device metrics", "err", err)
+			return
+		}
+	}
+	// OpenMetrics ends with # EOF
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("Error encoding device metrics", "err", err)
+		}
+	}
+}
+
+// filterByLabel keeps only the metrics that have the given label value,
+// dropping families left empty.
+func filterByLabel(families []*dto.MetricFamily, name, value string) []*dto.MetricFamily {
+	var filtered []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == name && label.GetValue() == value {
+					metrics = append(metrics, metric)
+					break
+				}
+			}
+		}
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsHandlerNegotiation(t *testing.T) {
+	counterTypes = true
+	defer func() { counterTypes = false }()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(cachedCollector([]metricSample{
+		{Name: "smartctl_device_power_on_hours", Labels: prometheus.Labels{"device": "sda"}, Value: 12345},
+		{Name: "smartctl_power_on_hours", Labels: prometheus.Labels{"device": "sda"}, Value: 98},
+	}))
+	handler := metricsHandler(reg)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		want        []string
+	}{
+		{
+			name:        "text",
+			accept:      "text/plain",
+			contentType: "text/plain; version=0.0.4",
+			want: []string{
+				"# TYPE smartctl_device_power_on_hours_total counter",
+				`smartctl_device_power_on_hours_total{device="sda"} 12345`,
+				"# TYPE smartctl_power_on_hours gauge",
+			},
+		},
+		{
+			name:        "openmetrics",
+			accept:      "application/openmetrics-text;version=0.0.1",
+			contentType: "application/openmetrics-text; version=0.0.1",
+			want: []string{
+				"# TYPE smartctl_device_power_on_hours counter",
+				`smartctl_device_power_on_hours_total{device="sda"} 12345.0`,
+				"# TYPE smartctl_power_on_hours gauge",
+				"# EOF",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			body, _ := io.ReadAll(rec.Body)
+			for _, line := range tt.want {
+				if !strings.Contains(string(body), line+"\n") {
+					t.Errorf("response lacks %q:\n%s", line, body)
+				}
+			}
+			if strings.Contains(string(body), " unknown\n") {
+				t.Errorf("response has metrics typed unknown:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestReadyAfterRefresh(t *testing.T) {
+	useRunners(t, fakeRunner{}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{}
+	t.Cleanup(func() { devices = savedDevices })
+	ready.Store(false)
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before the first cycle = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	// As at startup, without a scrape of /metrics
+	newSmartCollector(time.Hour).refresh()
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("/readyz after the first cycle = %d, want %d", code, http.StatusOK)
+	}
+}
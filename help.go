@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// metricDescriptions is the HELP text of well-known metrics, keyed by the
+// metric name without the smartctl_ prefix.
+var metricDescriptions = map[string]string{
+	// Exported for every device type
+	"smart_passed":                       "1 if the drive passes its SMART overall health self-assessment, 0 if it fails",
+	"device_info":                        "Always 1, labeled with the drive's type, model, serial number and firmware version",
+	"device_up":                          "1 if the last probe of the drive succeeded, 0 if smartctl failed or its output couldn't be parsed",
+	"device_down_reason":                 "Always 1 while device_up is 0, labeled with why the drive couldn't be read",
+	"device_temperature_celsius":         "Drive temperature in degrees Celsius",
+	"device_power_on_hours":              "Hours the drive has been powered on",
+	"device_power_cycle_count":           "Times the drive has been powered on",
+	"device_smartctl_exit_code":          "Exit status bitmask of the smartctl call that read the drive",
+	"device_collection_duration_seconds": "Time the last collection took to read the drive",
+	"device_capacity_bytes":              "User capacity of the drive in bytes",
+	"device_rotation_rate_rpm":           "Spindle speed of the drive in revolutions per minute, 0 for solid state drives",
+	"device_selftest_progress_percent":   "Progress of the running self-test",
+	"host_read_bytes":                    "Bytes read by the host",
+	"host_written_bytes":                 "Bytes written by the host",
+	"temperature_sensor_celsius":         "Reading of an NVMe temperature sensor in degrees Celsius",
+	"ata_attribute":                      "Normalized value of an ATA attribute by ID",
+	"ata_attribute_raw":                  "Raw value of an ATA attribute by ID",
+	"ata_attribute_margin":               "Normalized value of an ATA attribute minus its failure threshold",
+	"ata_error_by_type":                  "Errors in the comprehensive ATA error log by type",
+	"ata_error_log_count":                "Errors the ATA drive logged over its lifetime",
+	"ata_current_pending_sectors":        "Unstable sectors waiting to be remapped (ATA attribute 197)",
+	"ata_offline_uncorrectable":          "Sectors that couldn't be read or written (ATA attribute 198)",
+	"ata_lbas_written":                   "LBAs written (ATA attribute 241)",
+	"ata_lbas_read":                      "LBAs read (ATA attribute 242)",
+	"scsi_grown_defect_list_count":       "Sectors the SCSI drive remapped since it left the factory",
+	"scsi_errors":                        "Counters of the SCSI error counter log by operation",
+	"scsi_start_stop_cycles":             "Start/stop cycles of the SCSI drive",
+	"scsi_start_stop_cycles_specified":   "Start/stop cycles the SCSI drive is specified for over its lifetime",
+	"scsi_load_unload_cycles":            "Head load/unload cycles of the SCSI drive",
+	"scsi_load_unload_cycles_specified":  "Head load/unload cycles the SCSI drive is specified for over its lifetime",
+	"nvme_controller_busy_minutes":       "Minutes the NVMe controller was busy with I/O commands",
+	"nvme_host_read_commands":            "Read commands completed by the NVMe controller",
+	"nvme_host_write_commands":           "Write commands completed by the NVMe controller",
+	"temperature_celsius":                "Normalized value of ATA attribute 194, or the temperature in degrees Celsius from the SCT status log of drives without it",
+	"temperature":                        "NVMe composite temperature in degrees Celsius, see device_temperature_celsius for every device type",
+	"temperature_current_celsius":        "Current SCSI drive temperature in degrees Celsius",
+	"temperature_drive_trip_celsius":     "SCSI drive trip temperature in degrees Celsius",
+	"power_on_hours":                     "Power-on hours attribute: the normalized value on ATA drives, hours on NVMe drives",
+
+	// Derived from the NVMe health log
+	"nvme_percentage_used_ratio":           "NVMe vendor estimate of the drive life used, 1 at the rated endurance. Can exceed 1",
+	"nvme_available_spare_ratio":           "NVMe spare capacity remaining, from 0 to 1",
+	"nvme_available_spare_below_threshold": "1 if the NVMe spare capacity is below the threshold the vendor set",
+	"ata_self_test_passed":                 "1 if the last ATA self-test passed, 0 if it failed",
+	"ata_self_test_power_on_hours":         "Power-on hours of the ATA drive when the last self-test ran",
+	"nvme_self_test_status":                "Result of the last NVMe self-test, 0 if it completed without error",
+	"nvme_self_test_power_on_hours":        "Power-on hours of the NVMe drive when the last self-test ran",
+	"nvme_data_read_bytes":                 "Bytes read from the NVMe drive, from the data units read",
+	"nvme_data_written_bytes":              "Bytes written to the NVMe drive, from the data units written",
+
+	// NVMe health log
+	"critical_warning":             "NVMe critical warning bits, 0 when no warning is raised",
+	"nvme_critical_warning":        "1 if the NVMe critical warning bit is set",
+	"available_spare":              "NVMe spare capacity remaining in percent",
+	"available_spare_threshold":    "NVMe spare capacity in percent below which a warning is raised",
+	"percentage_used":              "NVMe vendor estimate of the drive life used in percent",
+	"data_units_read":              "NVMe data units of 512000 bytes read",
+	"data_units_written":           "NVMe data units of 512000 bytes written",
+	"host_reads":                   "NVMe read commands completed",
+	"host_writes":                  "NVMe write commands completed",
+	"controller_busy_time_seconds": "NVMe time the controller was busy with I/O commands, in seconds",
+	"warning_temp_time_seconds":    "NVMe time the composite temperature was above the warning threshold, in seconds",
+	"critical_comp_time_seconds":   "NVMe time the composite temperature was above the critical threshold, in seconds",
+	"power_cycles":                 "NVMe power cycles",
+	"unsafe_shutdowns":             "NVMe shutdowns without prior notification",
+	"media_errors":                 "NVMe unrecovered data integrity errors",
+	"num_err_log_entries":          "NVMe error log entries over the life of the controller",
+}
+
+// ataAttributeDescriptions describes well-known ATA attributes, keyed by their
+// sanitized name as smartctl prints it.
+var ataAttributeDescriptions = map[string]string{
+	"raw_read_error_rate":     "Rate of hardware read errors",
+	"throughput_performance":  "Overall throughput performance",
+	"spin_up_time":            "Time the spindle takes to spin up",
+	"start_stop_count":        "Spindle start/stop cycles",
+	"reallocated_sector_ct":   "Reallocated sectors",
+	"seek_error_rate":         "Rate of seek errors of the heads",
+	"seek_time_performance":   "Average performance of seek operations",
+	"spin_retry_count":        "Retried spin-up attempts",
+	"calibration_retry_count": "Retried recalibrations",
+	"power_on_hours":          "Hours in power-on state",
+	"power_cycle_count":       "Power cycles",
+	"runtime_bad_block":       "Bad blocks found at runtime",
+	"end_to_end_error":        "Parity errors in the data path to the media",
+	"reported_uncorrect":      "Errors that couldn't be recovered with ECC",
+	"command_timeout":         "Commands aborted because of a timeout",
+	"high_fly_writes":         "Writes with the head flying outside its normal range",
+	"airflow_temperature_cel": "Airflow temperature in degrees Celsius",
+	"g_sense_error_rate":      "Errors caused by external shock or vibration",
+	"power_off_retract_count": "Emergency head retracts on power loss",
+	"load_cycle_count":        "Head load/unload cycles",
+	"temperature_celsius":     "Drive temperature in degrees Celsius",
+	"hardware_ecc_recovered":  "Errors corrected by hardware ECC",
+	"reallocated_event_count": "Sector remap operations",
+	"current_pending_sector":  "Unstable sectors waiting to be remapped",
+	"offline_uncorrectable":   "Sectors that couldn't be read or written",
+	"udma_crc_error_count":    "CRC errors in transfers over the interface cable",
+	"multi_zone_error_rate":   "Errors found when writing a sector",
+	"wear_leveling_count":     "Wear leveling count of flash cells",
+	"total_lbas_written":      "LBAs written",
+	"total_lbas_read":         "LBAs read",
+}
+
+// ataAttributeSeries describes the series exported for each ATA attribute by
+// their metric name suffix. Longer suffixes come first.
+var ataAttributeSeries = []struct {
+	suffix string
+	format string
+}{
+	{"_raw_min", "%s, lowest raw value"},
+	{"_raw_max", "%s, highest raw value"},
+	{"_raw", "%s, raw value"},
+	{"_worst", "%s, worst normalized value"},
+	{"_threshold", "%s, failure threshold of the normalized value"},
+	{"_prefail", "%s, 1 for a pre-failure attribute"},
+	{"", "%s, normalized value"},
+}
+
+// metricHelp derives the HELP text from the sanitized metric name alone, so
+// that it doesn't depend on which device or attribute spelling was collected
+// first.
+func metricHelp(metricName string) string {
+	name := strings.TrimPrefix(metricName, "smartctl_")
+	if description, ok := metricDescriptions[name]; ok {
+		return description
+	}
+	for _, series := range ataAttributeSeries {
+		if !strings.HasSuffix(name, series.suffix) {
+			continue
+		}
+		if description, ok := ataAttributeDescriptions[strings.TrimSuffix(name, series.suffix)]; ok {
+			return fmt.Sprintf(series.format, description)
+		}
+	}
+	return "SMART attribute " + name
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// permissionWarned is set once the warning about missing privileges was
+// logged, so that rescans don't repeat it.
+var permissionWarned bool
+
+// permissionDenied reports whether smartctl failed to open a device for lack
+// of privileges, judging by its output or open error.
+func permissionDenied(output string) bool {
+	return strings.Contains(output, "Permission denied") || strings.Contains(output, "Operation not permitted")
+}
+
+// warnPermissionDenied logs once that smartctl couldn't open some devices for
+// lack of privileges. Those devices aren't probed again until a rescan.
+func warnPermissionDenied(count int) {
+	if count == 0 || permissionWarned {
+		return
+	}
+	permissionWarned = true
+	slog.Warn("smartctl was denied access to devices, run the exporter as root or grant it CAP_SYS_RAWIO (and CAP_SYS_ADMIN for NVMe drives)", "devices", count)
+}
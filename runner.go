@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// SmartctlRunner runs smartctl with the given arguments and returns its
+// output on stdout and its exit status. Tests replace the runners with one
+// returning canned JSON.
+type SmartctlRunner interface {
+	Run(args []string) ([]byte, int, error)
+}
+
+// commandRunner runs a binary taking smartctl's arguments.
+type commandRunner struct {
+	path string
+}
+
+func (r commandRunner) Run(args []string) ([]byte, int, error) {
+	drive := commandDrive(args)
+	smartctlInvocations.WithLabelValues(drive, commandName(args)).Inc()
+	output, exitCode, err := runCmd(r.path, args)
+	if errors.Is(err, errTimedOut) && drive != "" {
+		collectionTimeouts.WithLabelValues(drive).Inc()
+	}
+	return output, exitCode, err
+}
+
+// commandName sums up what a smartctl command reads, such as "-A -H" or
+// "-l selftest": its arguments without the device, its -d type and the JSON
+// output option.
+func commandName(args []string) string {
+	if len(args) > 0 && !strings.HasPrefix(args[len(args)-1], "-") {
+		args = args[:len(args)-1]
+	}
+	var name []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-d":
+			i++
+		case strings.HasPrefix(args[i], "--json"), strings.HasPrefix(args[i], "-j"):
+		default:
+			name = append(name, args[i])
+		}
+	}
+	return strings.Join(name, " ")
+}
+
+// smartctlRunner runs every smartctl call, set up in main() from
+// --smartctl-path or --input-dir.
+var smartctlRunner SmartctlRunner = commandRunner{path: "smartctl"}
+
+// controllerRunner runs the calls probing drives behind RAID controllers,
+// nil to use smartctlRunner. main() sets it from --controller-command.
+var controllerRunner SmartctlRunner
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeRunner answers smartctl calls with canned output, keyed by the
+// arguments joined with spaces. Other calls fail like smartctl does on a
+// device it can't open.
+type fakeRunner map[string]string
+
+func (r fakeRunner) Run(args []string) ([]byte, int, error) {
+	output, ok := r[strings.Join(args, " ")]
+	if !ok {
+		return nil, 2, errors.New("exit status 2")
+	}
+	return []byte(output), 0, nil
+}
+
+// countingRunner is a fakeRunner that counts the calls it answers.
+type countingRunner struct {
+	fakeRunner
+	calls map[string]int
+}
+
+func (r *countingRunner) Run(args []string) ([]byte, int, error) {
+	r.calls[strings.Join(args, " ")]++
+	return r.fakeRunner.Run(args)
+}
+
+// useRunners makes smartctl and controller calls go to the fake runners for
+// the duration of a test. A nil controller runner falls back to smartctl.
+func useRunners(t *testing.T, smartctl, controller SmartctlRunner) {
+	t.Helper()
+	savedSmartctl, savedController := smartctlRunner, controllerRunner
+	smartctlRunner, controllerRunner = smartctl, controller
+	t.Cleanup(func() {
+		smartctlRunner, controllerRunner = savedSmartctl, savedController
+		discoveryOutputs = make(map[string]commandOutput)
+	})
+}
+
+func TestControllerProbe(t *testing.T) {
+	const dev, id = "/dev/bus/0", "megaraid,5"
+	collectArgs := strings.Join(collectCommandArgs("megaraid", dev, id), " ")
+
+	tests := []struct {
+		name     string
+		runner   fakeRunner
+		wantType string // "" when the probe fails
+		wantAttr string
+		want     float64
+	}{
+		{
+			name: "ATA behind MegaRAID",
+			runner: fakeRunner{
+				collectArgs: `{"device":{"protocol":"ATA"},"model_name":"ST4000NM0035","serial_number":"ZC1","firmware_version":"TN03",
+					"smart_status":{"passed":true},"ata_smart_attributes":{"table":[
+					{"id":5,"name":"Reallocated_Sector_Ct","value":100,"worst":100,"thresh":10,"raw":{"value":8,"string":"8"}}]}}`,
+			},
+			wantType: "sat",
+			wantAttr: "Reallocated_Sector_Ct_raw",
+			want:     8,
+		},
+		{
+			name: "SCSI behind MegaRAID",
+			runner: fakeRunner{
+				collectArgs: `{"device":{"protocol":"SCSI"},"scsi_model_name":"HGST HUC101818CS4200","serial_number":"S2","scsi_revision":"A3C0",
+					"smart_status":{"passed":true},"scsi_grown_defect_list":3}`,
+			},
+			wantType: "scsi",
+			wantAttr: "scsi_grown_defect_list_count",
+			want:     3,
+		},
+		{
+			name:   "probe failure",
+			runner: fakeRunner{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the controller runner answers, controller calls must use it
+			runner := &countingRunner{fakeRunner: tt.runner, calls: map[string]int{}}
+			useRunners(t, fakeRunner{}, runner)
+
+			device := getControllerDeviceInfo(dev, "megaraid", id)
+			if tt.wantType == "" {
+				if device != nil {
+					t.Errorf("getControllerDeviceInfo() = %+v, want nil", device)
+				}
+			} else if device == nil {
+				t.Fatal("getControllerDeviceInfo() = nil")
+			} else if device.Type != tt.wantType {
+				t.Errorf("device type = %q, want %q", device.Type, tt.wantType)
+			}
+
+			attrs, _, _ := smartController(dev, "megaraid", id, nil)
+			if tt.wantType == "" {
+				if attrs != nil {
+					t.Errorf("smartController() = %v, want nil", attrs)
+				}
+				return
+			}
+			if got, ok := attrs[tt.wantAttr]; !ok || got != tt.want {
+				t.Errorf("%s = %v (present %v), want %v", tt.wantAttr, got, ok, tt.want)
+			}
+			if attrs["smart_passed"] != 1 {
+				t.Errorf("smart_passed = %v, want 1", attrs["smart_passed"])
+			}
+			// The first collection reuses the call that identified the disk
+			if calls := runner.calls[collectArgs]; calls != 1 || len(runner.calls) != 1 {
+				t.Errorf("smartctl calls = %v, want one %q", runner.calls, collectArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// selfTestAPI enables POST /selftest.
+var selfTestAPI bool
+
+// selfTestTypes are the self-tests /selftest can start.
+var selfTestTypes = map[string]bool{"short": true, "long": true, "conveyance": true}
+
+// selfTestHandler serves POST /selftest?device=/dev/sda&type=short, which
+// starts a self-test on the device and returns when it should complete. The
+// device is its name or drive label.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("device")
+	testType := r.URL.Query().Get("type")
+	if name == "" || !selfTestTypes[testType] {
+		http.Error(w, "expected device and type (short, long or conveyance) parameters", http.StatusBadRequest)
+		return
+	}
+	device := findDevice(name)
+	if device == nil {
+		http.Error(w, "no device "+name, http.StatusNotFound)
+		return
+	}
+
+	run := runSmartctlCmd
+	typ := device.Type
+	if device.ControllerID != "" {
+		run = runControllerCmd
+		typ = device.ControllerID
+	}
+	// -c adds the polling minutes the completion time is estimated from
+	output, exitCode, err := run([]string{"-c", "-t", testType, "-d", typ, "--json=c", device.BusDevice})
+	// Bits 0 to 2 mean the test couldn't be started
+	if err != nil && (exitCode <= 0 || exitCode&7 != 0) {
+		slog.Warn("Could not start self-test", "device", device.Name, "type", testType, "exit_code", exitCode, "err", err)
+		http.Error(w, "smartctl could not start the self-test: "+err.Error()+"\n"+string(output), http.StatusBadGateway)
+		return
+	}
+	slog.Info("Started self-test", "device", device.Name, "type", testType)
+
+	var result struct {
+		AtaSmartData struct {
+			SelfTest struct {
+				PollingMinutes map[string]float64 `json:"polling_minutes"`
+			} `json:"self_test"`
+		} `json:"ata_smart_data"`
+	}
+	json.Unmarshal(output, &result)
+
+	response := struct {
+		Device              string     `json:"device"`
+		Type                string     `json:"type"`
+		EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+	}{Device: device.Name, Type: testType}
+	// Only ATA drives report how long their self-tests take, as polling
+	// minutes keyed by the smartctl -t name except long being extended
+	key := testType
+	if key == "long" {
+		key = "extended"
+	}
+	if minutes, ok := result.AtaSmartData.SelfTest.PollingMinutes[key]; ok {
+		completion := time.Now().Add(time.Duration(minutes * float64(time.Minute))).UTC()
+		response.EstimatedCompletion = &completion
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,282 +1,1412 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/spf13/pflag"
 )
 
 const version = "0.1.3"
 
 type Device struct {
-	Name         string
-	Type         string
-	ModelFamily  string
-	ModelName    string
-	SerialNumber string
-	UserCapacity string
-	BusDevice    string
-	MegaraidID   string
+	Name             string // Unique name used for the drive label
+	Type             string
+	ModelFamily      string
+	ModelName        string
+	SerialNumber     string
+	FirmwareVersion  string
+	Namespace        string // NVMe namespace of the device path, such as 1 for /dev/nvme0n1
+	CapacityBytes    int64  // 0 when smartctl doesn't report it
+	RotationRate     *int64 // RPM, 0 for solid state drives, nil when smartctl doesn't report it
+	WWN              string
+	LogicalBlockSize int64
+	BusDevice        string // Device path passed to smartctl
+	Controller       string // Controller family of a disk behind a RAID controller or HBA
+	ControllerID     string // -d argument selecting the disk behind the controller
+	PermissionDenied bool   // smartctl lacked the privileges to open the device
 }
 
+// labeledValue is a sample that carries labels in addition to the device labels,
+// such as the attribute name of a per-attribute metric.
+type labeledValue struct {
+	Name   string
+	Labels prometheus.Labels
+	Value  float64
+}
+
+var (
+	devices       = make(map[string]*Device)
+	history       = make(map[string]map[string][]float64)
+	failedDevices = make(map[string]bool)
+	bayMap        map[string]string
+	deferred      = make(map[string]bool) // devices skipped by the last cycle's deadline
+	presence      = make(map[string]bool) // devices seen by any scan, true if present in the last one
+	bbuReported   = make(map[string]bool) // controllers with a controller_bbu_status value
+	bbuSeen       = make(map[string]bool) // controllers the BBU command ran for
+	satTypes      = []string{"sat", "usbjmicron", "usbprolific", "usbsunplus"}
+	nvmeTypes     = []string{"nvme", "sntasmedia", "sntjmicron", "sntrealtek"}
+	scsiTypes     = []string{"scsi"}
+	mutex         = &sync.Mutex{}
+
+	// Samples of each device's last collection, exported again while the
+	// device is deferred so that its series don't go stale
+	lastSamples = make(map[string][]metricSample)
+
+	excludedAttributeIDs   = make(map[int]bool)
+	excludedAttributeNames = make(map[string]bool)
+
+	// ATA attributes also exported under a stable name, since the attribute
+	// name string varies by vendor
+	ataAttributesByID = map[int]string{
+		9:   "device_power_on_hours",
+		12:  "device_power_cycle_count",
+		197: "ata_current_pending_sectors",
+		198: "ata_offline_uncorrectable",
+		241: "ata_lbas_written",
+		242: "ata_lbas_read",
+	}
+
+	// NVMe health log fields also exported under a stable, descriptive name
+	nvmeAttributeNames = map[string]string{
+		"controller_busy_time": "nvme_controller_busy_minutes",
+		"host_reads":           "nvme_host_read_commands",
+		"host_writes":          "nvme_host_write_commands",
+		"power_on_hours":       "device_power_on_hours",
+		"power_cycles":         "device_power_cycle_count",
+	}
+
+	// Metrics known to only ever increase over the life of a drive. They are
+	// exported as <name>_total counters unless --counter-types=false is given.
+	// Normalized ATA values, such as the power_on_hours attribute, go down as
+	// the drive ages and aren't listed.
+	counterMetrics = []string{
+		"smartctl_power_on_hours_raw",
+		"smartctl_power_cycle_count_raw",
+		"smartctl_start_stop_count_raw",
+		"smartctl_load_cycle_count_raw",
+		"smartctl_power_off_retract_count_raw",
+		"smartctl_reallocated_event_count_raw",
+		"smartctl_udma_crc_error_count_raw",
+		"smartctl_total_lbas_written_raw",
+		"smartctl_total_lbas_read_raw",
+		"smartctl_data_units_read",
+		"smartctl_data_units_written",
+		"smartctl_host_reads",
+		"smartctl_host_writes",
+		"smartctl_controller_busy_time_seconds",
+		"smartctl_unsafe_shutdowns",
+		"smartctl_media_errors",
+		"smartctl_num_err_log_entries",
+		"smartctl_nvme_controller_busy_minutes",
+		"smartctl_nvme_host_read_commands",
+		"smartctl_nvme_host_write_commands",
+		"smartctl_ata_lbas_written",
+		"smartctl_ata_lbas_read",
+		"smartctl_host_written_bytes",
+		"smartctl_host_read_bytes",
+		"smartctl_device_power_on_hours",
+		"smartctl_device_power_cycle_count",
+		"smartctl_nvme_data_read_bytes",
+		"smartctl_nvme_data_written_bytes",
+		"smartctl_scsi_grown_defect_list_count",
+		"smartctl_scsi_errors",
+		"smartctl_scsi_start_stop_cycles",
+		"smartctl_scsi_load_unload_cycles",
+		"smartctl_scsi_start_stop_cycle_counter_accumulated_start_stop_cycles",
+		"smartctl_scsi_start_stop_cycle_counter_accumulated_load_unload_cycles",
+		"smartctl_ata_error_log_count",
+	}
+)
+
+// Metrics about the exporter itself, registered in main(). Those about devices
+// are named without a prefix here, main() adds the --metric-prefix.
+var (
+	deviceSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "device_skipped_total",
+			Help: "Devices skipped during discovery or collection, by reason",
+		},
+		[]string{"reason"},
+	)
+	presenceFlaps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "device_presence_flaps_total",
+			Help: "Times a device went missing from a device scan and later returned",
+		},
+		[]string{"drive"},
+	)
+	deviceOpenError = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "device_open_error",
+			Help: "1 for a device the last device scan listed but couldn't open, with smartctl's error",
+		},
+		[]string{"drive", "error"},
+	)
+	controllerBBUStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "controller_bbu_status",
+			Help: "RAID controller battery backup unit status as reported by --controller-bbu-command (1 = OK)",
+		},
+		[]string{"controller"},
+	)
+	cycleOverruns = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smartctl_exporter_cycle_overrun_total",
+			Help: "Collection cycles that hit the --cycle-deadline before probing every device",
+		},
+	)
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "smartctl_exporter_build_info",
+			Help: "Always 1, labeled with the exporter, Go and smartctl versions",
+		},
+		[]string{"version", "go_version", "smartctl_version"},
+	)
+	collectionDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smartctl_exporter_collection_duration_seconds",
+			Help: "Time the last collection cycle took to read every device",
+		},
+	)
+	collectionTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "device_collection_timeout_total",
+			Help: "smartctl commands for a device killed after running longer than --smartctl-timeout",
+		},
+		[]string{"drive"},
+	)
+	controllerBBUTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "controller_bbu_timeouts_total",
+			Help: "--controller-bbu-command runs for a RAID controller killed after running longer than --smartctl-timeout",
+		},
+		[]string{"controller"},
+	)
+	exporterUp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smartctl_exporter_up",
+			Help: "1 if the last collection cycle completed with smartctl available, 0 otherwise",
+		},
+	)
+	scrapeCycles = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smartctl_exporter_scrape_cycles_total",
+			Help: "Collection cycles run",
+		},
+	)
+	deviceScrapeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smartctl_exporter_device_scrape_errors_total",
+			Help: "Collections of a device that failed because smartctl failed or its output couldn't be parsed",
+		},
+		[]string{"drive"},
+	)
+	smartctlInvocations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smartctl_exporter_smartctl_invocations_total",
+			Help: "smartctl commands run, by drive and command",
+		},
+		[]string{"drive", "command"},
+	)
+	metricRegistrationErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smartctl_exporter_metric_registration_errors_total",
+			Help: "Device metrics dropped from scrapes because their name was invalid or collided with another metric",
+		},
+	)
+)
+
+// Options set from command-line flags in main().
 var (
-	labelNames = []string{
-		"drive",
-		"type",
-		"model_family",
-		"model_name",
-		"serial_number",
-		"user_capacity",
-	}
-	devices        = make(map[string]*Device)
-	metrics        = make(map[string]*prometheus.GaugeVec)
-	satTypes       = []string{"sat", "usbjmicron", "usbprolific", "usbsunplus"}
-	nvmeTypes      = []string{"nvme", "sntasmedia", "sntjmicron", "sntrealtek"}
-	scsiTypes      = []string{"scsi"}
-	megaraidRegexp = regexp.MustCompile(`(sat\+)?(megaraid,(\d+))`)
-	mutex          = &sync.Mutex{}
+	smartctlPath         = "smartctl"
+	counterTypes         = false
+	duplicateDevices     = "suffix"
+	reportWorstOver      = 0
+	onFailureCommand     = ""
+	controllerCommand    = ""
+	quietDiscovery       = false
+	controllerBBUCommand = ""
+	selfTestProgress     = false
+	selfTestLog          = false
+	portFallback         = false
+	ataErrorLog          = false
+	cycleDeadline        = time.Duration(0)
+	smartctlTimeout      = 30 * time.Second
+	concurrency          = 4
+	rescanInterval       = 5 * time.Minute
+	noScan               = false
+	exposeInfoLabels     = false
+	includeGoMetrics     = false
+	unixSocketMode       = os.FileMode(0660)
 )
 
+// cmdContext is cancelled on shutdown, killing in-flight commands.
+var cmdContext = context.Background()
+
 func runSmartctlCmd(args []string) ([]byte, int, error) {
-	cmd := exec.Command("smartctl", args...)
-	output, err := cmd.CombinedOutput()
+	return smartctlRunner.Run(args)
+}
+
+// smartctlVersion returns the version smartctl reports in the first line of
+// its --version output, such as "7.3", or "unknown".
+func smartctlVersion() string {
+	output, _, err := runSmartctlCmd([]string{"--version"})
+	if err != nil {
+		slog.Error("Error getting smartctl version", "err", err)
+		return "unknown"
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || fields[0] != "smartctl" {
+		return "unknown"
+	}
+	return fields[1]
+}
+
+// minSmartctlVersion is the first smartctl release with --json output.
+const minSmartctlVersion = "7.0"
+
+// smartctlTooOld reports whether a smartctl version is older than
+// minSmartctlVersion. Versions that can't be parsed aren't too old.
+func smartctlTooOld(v string) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(v, "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	var minMajor, minMinor int
+	fmt.Sscanf(minSmartctlVersion, "%d.%d", &minMajor, &minMinor)
+	return major < minMajor || major == minMajor && minor < minMinor
+}
+
+// runControllerCmd runs a smartctl command against a drive behind a RAID
+// controller. --controller-command replaces smartctl for these probes, e.g.
+// with a script that replays captured JSON when the hardware isn't available.
+func runControllerCmd(args []string) ([]byte, int, error) {
+	if controllerRunner != nil {
+		return controllerRunner.Run(args)
+	}
+	return runSmartctlCmd(args)
+}
+
+// errTimedOut is wrapped by the error of a command killed after
+// --smartctl-timeout.
+var errTimedOut = errors.New("timed out")
+
+func runCmd(name string, args []string) ([]byte, int, error) {
+	ctx := cmdContext
+	if smartctlTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smartctlTimeout)
+		defer cancel()
+	}
+	// Keep stderr out of the JSON on stdout, smartctl sometimes warns there
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
 	exitCode := cmd.ProcessState.ExitCode()
+	if cmdContext.Err() != nil {
+		// Shutting down, the command was killed on purpose
+		return output, exitCode, cmdContext.Err()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("command '%s' %w after %s", strings.Join(cmd.Args, " "), errTimedOut, smartctlTimeout)
+		slog.Warn("Command timed out", "command", strings.Join(cmd.Args, " "), "timeout", smartctlTimeout)
+		return output, exitCode, err
+	}
     if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
         // Exit codes 2, 4, and 6 indicate SMART errors but still provide valid output
-		log.Printf("WARNING: Command '%s' returned exit code %d. Output: '%s'", strings.Join(cmd.Args, " "), exitCode, string(output))
+		slog.Warn("Command returned an error exit code", "command", strings.Join(cmd.Args, " "), "exit_code", exitCode, "output", string(output), "stderr", stderr.String())
+	} else if stderr.Len() > 0 {
+		slog.Debug("Command wrote to stderr", "command", strings.Join(cmd.Args, " "), "stderr", stderr.String())
 	}
 	return output, exitCode, err
 }
 
-func getDrives() map[string]*Device {
-	disks := make(map[string]*Device)
-	output, _, err := runSmartctlCmd([]string{"--scan-open", "--json=c"})
+// commandOptionValues are the smartctl options whose value is the next
+// argument rather than joined with "=".
+var commandOptionValues = []string{"-d", "--device", "-l", "--log", "-s", "--smart", "-t", "--test"}
+
+// commandDrive returns the drive label of the device a smartctl command probes:
+// its last argument, with the controller disk appended as in getDrives.
+// Commands without a device, such as a scan whose --scan-arg values end the
+// argument list, return "".
+func commandDrive(args []string) string {
+	n := len(args)
+	if n == 0 || strings.HasPrefix(args[n-1], "-") {
+		return ""
+	}
+	if n > 1 && contains(commandOptionValues, args[n-2]) {
+		return ""
+	}
+	for _, arg := range args {
+		if arg == "--scan" || arg == "--scan-open" || arg == "--version" {
+			return ""
+		}
+	}
+	drive := args[n-1]
+	for i := 0; i < len(args)-2; i++ {
+		if args[i] != "-d" {
+			continue
+		}
+		if _, id := controllerDeviceID(args[i+1]); id != "" {
+			drive += "_" + id
+		}
+	}
+	return sanitizeLabelValue(drive)
+}
+
+// scanEntry is a device listed by smartctl --scan-open or given with --device.
+type scanEntry struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	OpenError string `json:"open_error"`
+}
+
+// scanArgs are the --scan-arg values appended to the device scan command.
+var scanArgs []string
+
+// scanDevices lists the devices smartctl --scan-open finds.
+func scanDevices() ([]scanEntry, bool) {
+	// smartctl takes a single scan option, --scan-arg --scan replaces ours
+	args := []string{"--scan-open"}
+	if contains(scanArgs, "--scan") {
+		args = nil
+	}
+	args = append(append(args, "--json=c"), scanArgs...)
+	output, _, err := runSmartctlCmd(args)
 	if err != nil {
-		log.Println("Error scanning devices:", err)
-		return disks
+		slog.Error("Error scanning devices", "args", strings.Join(args, " "), "err", err)
+		return nil, false
 	}
 
 	var result struct {
-		Devices []struct {
-			Name      string `json:"name"`
-			Type      string `json:"type"`
-			OpenError string `json:"open_error"`
-		} `json:"devices"`
+		Devices []scanEntry `json:"devices"`
 	}
 
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing JSON:", err)
-		return disks
+		slog.Error("Error parsing device scan JSON", "err", err)
+		return nil, false
+	}
+	return result.Devices, true
+}
+
+// getDrives scans for devices and reads their identity. It returns nil when the
+// scan itself fails, so that a rescan can keep the devices it already knows.
+func getDrives() map[string]*Device {
+	disks := make(map[string]*Device)
+	var scanned []scanEntry
+	if !noScan {
+		var ok bool
+		if scanned, ok = scanDevices(); !ok {
+			return nil
+		}
+		deviceOpenError.Reset()
 	}
 
-	for _, device := range result.Devices {
+	// Outputs of an earlier discovery no collection used, e.g. of a controller
+	// disk speaking neither ATA nor SCSI
+	discoveryOutputsMu.Lock()
+	discoveryOutputs = make(map[string]commandOutput)
+	discoveryOutputsMu.Unlock()
+
+	// Devices given with --device come first and aren't filtered
+	entries := append([]scanEntry{}, staticDevices...)
+	denied := 0
+	// The namespaces of an NVMe controller share its health log, probe the
+	// first one that is included and opens, or the controller itself, only
+	nvmeControllers := make(map[string]string)
+	for _, device := range staticDevices {
+		if matchesType(nvmeTypes, device.Type) {
+			nvmeControllers[nvmeController(device.Name)] = device.Name
+		}
+	}
+	for _, device := range scanned {
+		if overriddenByStatic(device) {
+			continue
+		}
 		if device.OpenError != "" {
+			if permissionDenied(device.OpenError) {
+				denied++
+			}
+			// Devices filtered out anyway, such as empty CD drives, aren't reported
+			if deviceIncluded(device.Name) {
+				deviceOpenError.WithLabelValues(sanitizeLabelValue(device.Name), device.OpenError).Set(1)
+				slog.Debug("Device scan couldn't open device", "device", device.Name, "err", device.OpenError)
+			}
+			deviceSkipped.WithLabelValues("open_error").Inc()
+			continue
+		}
+		if !deviceIncluded(device.Name) {
+			deviceSkipped.WithLabelValues("excluded").Inc()
 			continue
 		}
+		if matchesType(nvmeTypes, device.Type) {
+			controller := nvmeController(device.Name)
+			if first, seen := nvmeControllers[controller]; seen {
+				deviceSkipped.WithLabelValues("nvme_namespace").Inc()
+				slog.Debug("Skipping NVMe namespace of a controller already probed", "device", device.Name, "probed", first)
+				continue
+			}
+			nvmeControllers[controller] = device.Name
+		}
+		entries = append(entries, device)
+	}
+
+	for _, device := range entries {
 		dev := device.Name
 		typ := device.Type
 
-		if megaraidRegexp.MatchString(typ) {
-			diskAttrs := getMegaraidDeviceInfo(dev, typ)
+		if controller, id := controllerDeviceID(typ); id != "" {
+			if reuseKnownDevice(disks, dev+"_"+id, dev, typ) {
+				continue
+			}
+			// The scan lists a disk once per -d variant reaching it, such as
+			// megaraid,0 and sat+megaraid,0
+			if known := controllerDisk(disks, dev, id); known != nil {
+				deviceSkipped.WithLabelValues("duplicate").Inc()
+				slog.Debug("Skipping controller disk already discovered", "device", dev, "type", typ, "known", known.Name)
+				continue
+			}
+			diskAttrs := getControllerDeviceInfo(dev, controller, id)
 			if diskAttrs == nil {
+				deviceSkipped.WithLabelValues("device_info").Inc()
+				continue
+			}
+			if skipSameDisk(disks, diskAttrs, dev) {
 				continue
 			}
-			diskAttrs.Type = getMegaraidDeviceType(dev, typ)
 			diskAttrs.BusDevice = dev
-			diskAttrs.MegaraidID = getMegaraidDeviceID(typ)
-            // Form a unique device name
-			diskAttrs.Name = dev + "_" + diskAttrs.MegaraidID
+			diskAttrs.Controller = controller
+			diskAttrs.ControllerID = id
+            // Form a unique device name from the bus device and controller target
+			name, ok := uniqueDeviceName(disks, dev+"_"+diskAttrs.ControllerID)
+			if !ok {
+				continue
+			}
+			diskAttrs.Name = name
             disks[diskAttrs.Name] = diskAttrs
-            log.Printf("Discovered device %s with attributes %+v\n", diskAttrs.Name, disks[diskAttrs.Name])
+            logDiscoveredDevice(diskAttrs)
 		} else {
-			diskAttrs := getDeviceInfo(dev)
+			if reuseKnownDevice(disks, dev, dev, typ) {
+				continue
+			}
+			name, ok := uniqueDeviceName(disks, dev)
+			if !ok {
+				continue
+			}
+			diskAttrs := getDeviceInfo(dev, typ)
+			if skipSameDisk(disks, diskAttrs, dev) {
+				continue
+			}
 			diskAttrs.Type = typ
-			diskAttrs.Name = dev
-            disks[dev] = diskAttrs
-            log.Printf("Discovered device %s with attributes %+v\n", dev, disks[dev])
+			if matchesType(nvmeTypes, typ) {
+				_, diskAttrs.Namespace = nvmeNamespace(dev)
+			}
+			diskAttrs.BusDevice = dev
+			diskAttrs.Name = name
+            disks[name] = diskAttrs
+            logDiscoveredDevice(diskAttrs)
 		}
 	}
 
+	for _, device := range disks {
+		if device.PermissionDenied {
+			denied++
+		}
+	}
+	warnPermissionDenied(denied)
 	return disks
 }
 
-func getDeviceInfo(dev string) *Device {
-	output, _, err := runSmartctlCmd([]string{"-i", "--json=c", dev})
-	if err != nil {
-		log.Println("Error getting device info:", err)
-		return &Device{}
+// controllerDisk returns the discovered disk behind a controller at a bus
+// device, or nil.
+func controllerDisk(disks map[string]*Device, dev, id string) *Device {
+	for _, known := range disks {
+		if known.BusDevice == dev && known.ControllerID == id {
+			return known
+		}
 	}
+	return nil
+}
 
-	var result struct {
-		ModelFamily  string `json:"model_family"`
-		ModelName    string `json:"model_name"`
-		SerialNumber string `json:"serial_number"`
-		UserCapacity struct {
-			Bytes int64 `json:"bytes"`
-		} `json:"user_capacity"`
+// skipSameDisk reports whether a newly identified device is a disk already
+// discovered under another path, by its WWN or else its model and serial
+// number, and counts it as a skipped duplicate. Its metrics would otherwise
+// be exported twice.
+func skipSameDisk(disks map[string]*Device, device *Device, dev string) bool {
+	for _, known := range disks {
+		same := false
+		switch {
+		case device.WWN != "" && known.WWN != "":
+			same = device.WWN == known.WWN
+		case device.SerialNumber != "":
+			same = device.SerialNumber == known.SerialNumber && device.ModelName == known.ModelName
+		}
+		if same {
+			deviceSkipped.WithLabelValues("duplicate").Inc()
+			slog.Debug("Skipping device already discovered under another path", "device", dev, "known", known.Name)
+			return true
+		}
 	}
+	return false
+}
 
+// nvmeNamespaceRegexp matches NVMe namespace block devices, capturing the
+// controller character device and the namespace.
+var nvmeNamespaceRegexp = regexp.MustCompile(`^(/dev/nvme\d+)n(\d+)$`)
+
+// nvmeNamespace splits an NVMe namespace device such as /dev/nvme0n1 into its
+// controller, /dev/nvme0, and namespace, 1. Both are "" for other devices.
+func nvmeNamespace(dev string) (string, string) {
+	matches := nvmeNamespaceRegexp.FindStringSubmatch(dev)
+	if matches == nil {
+		return "", ""
+	}
+	return matches[1], matches[2]
+}
+
+// nvmeController returns the controller of an NVMe namespace device, or the
+// device itself when it isn't a namespace.
+func nvmeController(dev string) string {
+	if controller, _ := nvmeNamespace(dev); controller != "" {
+		return controller
+	}
+	return dev
+}
+
+// reuseKnownDevice adds a device found by an earlier scan to disks, when the
+// scan lists it again under the same name and type, so that a rescan doesn't
+// run smartctl -i for every drive again. Devices smartctl was denied access to
+// are identified again, in case the exporter was granted access since.
+func reuseKnownDevice(disks map[string]*Device, name, dev, typ string) bool {
+	if _, taken := disks[name]; taken {
+		return false
+	}
+	known, ok := devices[name]
+	if !ok || known.PermissionDenied || known.BusDevice != dev {
+		return false
+	}
+	if _, id := controllerDeviceID(typ); id != known.ControllerID || id == "" && typ != known.Type {
+		return false
+	}
+	disks[name] = known
+	return true
+}
+
+// trackPresence compares a device scan with the previous ones and counts a flap
+// for every known device that returns after going missing.
+func trackPresence(disks map[string]*Device) {
+	for name, present := range presence {
+		if _, ok := disks[name]; !ok && present {
+			presence[name] = false
+			slog.Warn("Device is missing from the device scan", "device", name)
+		}
+	}
+	for name := range disks {
+		if present, known := presence[name]; known && !present {
+			presenceFlaps.WithLabelValues(sanitizeLabelValue(name)).Inc()
+			slog.Warn("Device is back after going missing", "device", name)
+		}
+		presence[name] = true
+	}
+}
+
+// rescan re-runs device discovery, adding new devices and dropping vanished
+// ones together with the state and series kept about them. Presence flaps are
+// kept, since a flapping drive is exactly one that comes and goes. It returns how many devices
+// were added and removed.
+func rescan() (added, removed int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	disks := getDrives()
+	if disks == nil {
+		return 0, 0
+	}
+	trackPresence(disks)
+	for name := range disks {
+		if _, ok := devices[name]; !ok {
+			added++
+		}
+	}
+	for name := range devices {
+		if _, ok := disks[name]; !ok {
+			removed++
+			delete(history, name)
+			delete(failedDevices, name)
+			delete(deferred, name)
+			delete(lastSamples, name)
+			delete(coverage, name)
+			delete(eventState, name)
+			delete(eventSent, name)
+			collectionTimeouts.DeleteLabelValues(sanitizeLabelValue(name))
+			deviceScrapeErrors.DeleteLabelValues(sanitizeLabelValue(name))
+			smartctlInvocations.DeletePartialMatch(prometheus.Labels{"drive": sanitizeLabelValue(name)})
+		}
+	}
+	devices = disks
+	if added > 0 || removed > 0 {
+		// Don't serve the cached samples of removed devices
+		deviceGeneration.Add(1)
+	}
+	return added, removed
+}
+
+// logDiscoveredDevice logs a newly discovered device unless --quiet-discovery
+// is set. Serial numbers and WWNs are left out of the log.
+func logDiscoveredDevice(device *Device) {
+	if quietDiscovery {
+		return
+	}
+	slog.Debug("Discovered device", "device", device.Name, "type", device.Type, "model", device.ModelName)
+}
+
+// uniqueDeviceName returns a map key for a newly discovered device. When the
+// name is already taken it is either disambiguated with an incrementing suffix
+// or rejected, depending on --duplicate-devices.
+func uniqueDeviceName(disks map[string]*Device, name string) (string, bool) {
+	if _, exists := disks[name]; !exists {
+		return name, true
+	}
+	if duplicateDevices == "skip" {
+		deviceSkipped.WithLabelValues("duplicate").Inc()
+		slog.Warn("Device name is already in use, skipping duplicate", "device", name)
+		return "", false
+	}
+	for i := 1; ; i++ {
+		candidate := name + "_" + strconv.Itoa(i)
+		if _, exists := disks[candidate]; !exists {
+			slog.Warn("Device name is already in use, registering duplicate under a new name", "device", name, "name", candidate)
+			return candidate, true
+		}
+	}
+}
+
+func getDeviceInfo(dev, typ string) *Device {
+	args, reused := identifyArgs(deviceCollectArgs(&Device{BusDevice: dev, Type: typ}), []string{"-i", "--json=c", dev})
+	output, exitCode, err := runSmartctlCmd(args)
+	if err != nil && permissionDenied(string(output)) {
+		return &Device{PermissionDenied: true}
+	}
+	// The per-cycle call exits with a bitmask, nonzero for a failing drive
+	if err != nil && (!reused || exitCode <= 0) {
+		slog.Error("Error getting device info", "device", dev, "err", err)
+		return &Device{}
+	}
+
+	var result deviceIdentity
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing device info JSON:", err)
+		slog.Error("Error parsing device info JSON", "device", dev, "err", err)
 		return &Device{}
 	}
+	if reused {
+		saveDiscoveryOutput(args, commandOutput{output, exitCode, err})
+	}
+	return result.device()
+}
+
+// identifyArgs returns the arguments of the smartctl call identifying a new
+// device: its per-cycle call when that includes -i, whose output the first
+// collection then reuses, or else a call of its own.
+func identifyArgs(collect, identify []string) ([]string, bool) {
+	if contains(collect, "-i") {
+		return collect, true
+	}
+	return identify, false
+}
+
+// commandOutput is what a smartctl call returned.
+type commandOutput struct {
+	output   []byte
+	exitCode int
+	err      error
+}
+
+// discoveryOutputs holds the output of the per-cycle smartctl calls that
+// identified new devices, keyed by their arguments, until the devices' first
+// collection.
+var (
+	discoveryOutputs   = make(map[string]commandOutput)
+	discoveryOutputsMu sync.Mutex
+)
+
+func saveDiscoveryOutput(args []string, output commandOutput) {
+	discoveryOutputsMu.Lock()
+	defer discoveryOutputsMu.Unlock()
+	discoveryOutputs[strings.Join(args, " ")] = output
+}
 
-	userCapacity := "Unknown"
-	if result.UserCapacity.Bytes > 0 {
-		userCapacity = strconv.FormatInt(result.UserCapacity.Bytes, 10)
+// runCollectCmd runs the per-cycle smartctl call of a device with run, unless
+// discovery just made the same call, whose output it returns instead.
+func runCollectCmd(run func([]string) ([]byte, int, error), args []string) ([]byte, int, error) {
+	key := strings.Join(args, " ")
+	discoveryOutputsMu.Lock()
+	saved, ok := discoveryOutputs[key]
+	delete(discoveryOutputs, key)
+	discoveryOutputsMu.Unlock()
+	if ok {
+		return saved.output, saved.exitCode, saved.err
 	}
+	return run(args)
+}
+
+// deviceIdentity is what smartctl -i reports about a drive. The per-cycle
+// call includes -i as well, so that identity changes such as a firmware
+// update show without a rescan.
+type deviceIdentity struct {
+	ModelFamily     string `json:"model_family"`
+	ModelName       string `json:"model_name"`
+	SerialNumber    string `json:"serial_number"`
+	FirmwareVersion string `json:"firmware_version"`
+	ScsiRevision    string `json:"scsi_revision"`
+	RotationRate    *int64 `json:"rotation_rate"`
+	UserCapacity    struct {
+		Bytes int64 `json:"bytes"`
+	} `json:"user_capacity"`
+	ScsiModelName    string `json:"scsi_model_name"`
+	LogicalBlockSize int64  `json:"logical_block_size"`
+	Wwn              struct {
+		Naa uint64 `json:"naa"`
+		Oui uint64 `json:"oui"`
+		ID  uint64 `json:"id"`
+	} `json:"wwn"`
+	Device struct {
+		Protocol string `json:"protocol"`
+	} `json:"device"`
+}
 
+// device returns the identity as a Device, without name or type.
+func (identity *deviceIdentity) device() *Device {
+	modelName := identity.ModelName
+	if identity.ScsiModelName != "" {
+		modelName = identity.ScsiModelName
+	}
 	return &Device{
-		ModelFamily:  result.ModelFamily,
-		ModelName:    result.ModelName,
-		SerialNumber: result.SerialNumber,
-		UserCapacity: userCapacity,
+		ModelFamily:      identity.ModelFamily,
+		ModelName:        modelName,
+		SerialNumber:     identity.SerialNumber,
+		FirmwareVersion:  firmwareVersion(identity.FirmwareVersion, identity.ScsiRevision),
+		CapacityBytes:    identity.UserCapacity.Bytes,
+		RotationRate:     identity.RotationRate,
+		WWN:              formatWWN(identity.Wwn.Naa, identity.Wwn.Oui, identity.Wwn.ID),
+		LogicalBlockSize: identity.LogicalBlockSize,
 	}
 }
 
-func getMegaraidDeviceInfo(dev, typ string) *Device {
-	megaraidID := getMegaraidDeviceID(typ)
-	if megaraidID == "" {
+// readIdentity returns the identity in the output of a per-cycle smartctl
+// call, or nil when the call didn't include -i.
+func readIdentity(output []byte) *Device {
+	var identity deviceIdentity
+	if err := json.Unmarshal(output, &identity); err != nil {
 		return nil
 	}
-	output, _, err := runSmartctlCmd([]string{"-i", "--json=c", "-d", megaraidID, dev})
-	if err != nil {
-		log.Println("Error getting MegaRAID device info:", err)
+	device := identity.device()
+	if device.ModelName == "" && device.SerialNumber == "" {
 		return nil
 	}
+	return device
+}
 
-	var result struct {
-		ModelFamily    string `json:"model_family"`
-		ModelName      string `json:"model_name"`
-		SerialNumber   string `json:"serial_number"`
-		UserCapacity   struct {
-			Bytes int64 `json:"bytes"`
-		} `json:"user_capacity"`
-		ScsiModelName string `json:"scsi_model_name"`
+// refreshIdentity copies what the last collection reported about a drive's
+// identity into the device. Fields the output lacks keep their value from
+// discovery.
+func refreshIdentity(device, identity *Device) {
+	if identity.ModelFamily != "" {
+		device.ModelFamily = identity.ModelFamily
 	}
-
-	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing MegaRAID device info JSON:", err)
-		return nil
+	if identity.ModelName != "" {
+		device.ModelName = identity.ModelName
 	}
-
-	modelName := result.ModelName
-	if result.ScsiModelName != "" {
-		modelName = result.ScsiModelName
+	if identity.SerialNumber != "" {
+		device.SerialNumber = identity.SerialNumber
+	}
+	if identity.FirmwareVersion != "" {
+		device.FirmwareVersion = identity.FirmwareVersion
+	}
+	if identity.CapacityBytes > 0 {
+		device.CapacityBytes = identity.CapacityBytes
+	}
+	if identity.RotationRate != nil {
+		device.RotationRate = identity.RotationRate
 	}
+	if identity.WWN != "" {
+		device.WWN = identity.WWN
+	}
+	if identity.LogicalBlockSize > 0 {
+		device.LogicalBlockSize = identity.LogicalBlockSize
+	}
+}
 
-	userCapacity := "Unknown"
-	if result.UserCapacity.Bytes > 0 {
-		userCapacity = strconv.FormatInt(result.UserCapacity.Bytes, 10)
+// identityKeys are the top-level fields smartctl -i adds to the output. They
+// describe the drive rather than measure anything, and are left out of the
+// generic parsing of SCSI output.
+var identityKeys = []string{
+	"model_family", "model_name", "serial_number", "firmware_version", "wwn",
+	"user_capacity", "logical_block_size", "physical_block_size", "rotation_rate",
+	"form_factor", "local_time", "smart_support", "in_smartctl_database", "trim",
+	"ata_version", "sata_version", "interface_speed", "ata_additional_product_id",
+	"scsi_vendor", "scsi_product", "scsi_model_name", "scsi_revision",
+	"scsi_version", "scsi_lb_provisioning", "scsi_protection_type",
+	"scsi_protection_interval_bytes_per_lb", "scsi_transport_protocol",
+	"scsi_serial_number", "logical_unit_id",
+	"nvme_pci_vendor", "nvme_ieee_oui_identifier", "nvme_controller_id",
+	"nvme_version", "nvme_number_of_namespaces", "nvme_namespaces",
+	"nvme_total_capacity", "nvme_unallocated_capacity",
+	"device_type", "vendor", "product", "revision",
+	"read_cache_enabled", "write_cache_enabled", "temperature_warning",
+}
+
+// dropIdentity removes the identity fields from generically parsed output.
+func dropIdentity(result map[string]interface{}) {
+	for _, key := range identityKeys {
+		delete(result, key)
 	}
+}
 
-	return &Device{
-		ModelFamily:  result.ModelFamily,
-		ModelName:    modelName,
-		SerialNumber: result.SerialNumber,
-		UserCapacity: userCapacity,
+// firmwareVersion returns the firmware version of ATA and NVMe drives, or the
+// revision SCSI drives report instead.
+func firmwareVersion(firmware, scsiRevision string) string {
+	if firmware != "" {
+		return firmware
 	}
+	return scsiRevision
 }
 
-func getMegaraidDeviceType(dev, typ string) string {
-	megaraidID := getMegaraidDeviceID(typ)
-	if megaraidID == "" {
-		return "unknown"
+// rotationRate returns the spindle speed of a drive in RPM, 0 for solid state
+// drives, and whether it is known. NVMe drives don't report it, being solid
+// state.
+func rotationRate(device *Device) (int64, bool) {
+	if device.RotationRate != nil {
+		return *device.RotationRate, true
 	}
-	output, _, err := runSmartctlCmd([]string{"-i", "--json=c", "-d", megaraidID, dev})
-	if err != nil {
-		log.Println("Error getting MegaRAID device type:", err)
-		return "unknown"
+	if device.ControllerID == "" && matchesType(nvmeTypes, device.Type) {
+		return 0, true
 	}
+	return 0, false
+}
 
-	var result struct {
-		Device struct {
-			Protocol string `json:"protocol"`
-		} `json:"device"`
+// mediaType classifies a drive as "ssd" or "hdd" by its rotation rate, or ""
+// when smartctl doesn't tell.
+func mediaType(device *Device) string {
+	rpm, ok := rotationRate(device)
+	switch {
+	case !ok:
+		return ""
+	case rpm == 0:
+		return "ssd"
 	}
+	return "hdd"
+}
 
+// getControllerDeviceInfo identifies a disk behind a RAID controller or HBA,
+// including the protocol it speaks, with a single smartctl call.
+func getControllerDeviceInfo(dev, controller, id string) *Device {
+	args, reused := identifyArgs(collectCommandArgs(controller, dev, id), []string{"-i", "--json=c", "-d", id, dev})
+	output, exitCode, err := runControllerCmd(args)
+	if err != nil && permissionDenied(string(output)) {
+		return &Device{PermissionDenied: true}
+	}
+	if err != nil && (!reused || exitCode <= 0) {
+		slog.Error("Error getting controller device info", "device", dev, "type", id, "err", err)
+		return nil
+	}
+
+	var result deviceIdentity
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing MegaRAID device type JSON:", err)
-		return "unknown"
+		slog.Error("Error parsing controller device info JSON", "device", dev, "type", id, "err", err)
+		return nil
+	}
+	if reused {
+		saveDiscoveryOutput(args, commandOutput{output, exitCode, err})
 	}
 
+	// The same call tells the protocol of the disk behind the controller
+	device := result.device()
+	device.Type = "unknown"
 	if result.Device.Protocol == "ATA" {
-		return "sat"
+		device.Type = "sat"
 	} else if result.Device.Protocol == "SCSI" {
-		return "scsi"
+		device.Type = "scsi"
 	}
-	return "unknown"
+	return device
 }
 
-func getMegaraidDeviceID(typ string) string {
-	matches := megaraidRegexp.FindStringSubmatch(typ)
-	if len(matches) >= 4 {
-		return matches[2]
-	}
-	return ""
+// deviceResult is what a collection worker read from one device.
+type deviceResult struct {
+	attrs       map[string]float64
+	labeled     []labeledValue
+	coverage    *deviceCoverage
+	duration    time.Duration
+	deferred    bool // not reached before the --cycle-deadline
+	unknownType bool
+	// smartctl can't open the device, it isn't probed until a rescan
+	permissionDenied bool
+	panicked         bool
+	// identity reported by the same smartctl call, nil when it had no -i
+	identity *Device
 }
 
-func collect() {
+// collect reads every device, up to --concurrency at a time, and returns the
+// resulting samples. Workers only run smartctl and parse its output; the
+// results are merged into the shared state afterwards, in collection order.
+// It reports false when reading a device panicked.
+func collect() ([]metricSample, bool) {
 	mutex.Lock()
 	defer mutex.Unlock()
+	scrapeCycles.Inc()
+
+	order := collectionOrder()
+	results := make([]deviceResult, len(order))
+	start := time.Now()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, name := range order {
+		// Wait for a free worker first, so the deadline is checked when the
+		// device would actually be probed
+		sem <- struct{}{}
+		if cycleDeadline > 0 && time.Since(start) > cycleDeadline {
+			<-sem
+			results[i].deferred = true
+			continue
+		}
+		wg.Add(1)
+		go func(i int, device *Device) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// collectCycle can't recover a panic in another goroutine, it
+			// would kill the exporter
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Reading device panicked", "device", device.Name, "panic", r, "stack", string(debug.Stack()))
+					results[i] = deviceResult{panicked: true}
+				}
+			}()
+			results[i] = readDevice(device)
+		}(i, devices[name])
+	}
+	wg.Wait()
+
+	completed := true
+	for _, result := range results {
+		if result.panicked {
+			completed = false
+		}
+	}
+
+	var samples []metricSample
+	overrun := false
+	for i, name := range order {
+		device := devices[name]
+		result := results[i]
+		if result.deferred {
+			if !overrun {
+				overrun = true
+				cycleOverruns.Inc()
+				slog.Warn("Collection cycle exceeded the deadline, deferring remaining devices to the next cycle", "deadline", cycleDeadline)
+			}
+			deferred[name] = true
+			deviceSkipped.WithLabelValues("cycle_deadline").Inc()
+			if last, ok := lastSamples[name]; ok {
+				samples = append(samples, last...)
+			} else {
+				samples = append(samples, metricSample{
+					Name:   "smartctl_device_info",
+					Labels: infoLabels(device),
+					Value:  1,
+				})
+			}
+			continue
+		}
+		delete(deferred, name)
+
+		if result.unknownType {
+			deviceSkipped.WithLabelValues("unknown_type").Inc()
+			continue
+		}
+		first := len(samples)
 
-	for _, device := range devices {
         drive := device.Name
 		typ := device.Type
-		var attrs map[string]float64
-
-		if device.MegaraidID != "" {
-			attrs = smartMegaraid(device.BusDevice, device.MegaraidID)
-		} else if contains(satTypes, typ) {
-            attrs = smartSat(drive)
-		} else if contains(nvmeTypes, typ) {
-            attrs = smartNvme(drive)
-		} else if contains(scsiTypes, typ) {
-            attrs = smartScsi(drive)
-		} else {
-			continue
+		attrs := result.attrs
+		labeled := result.labeled
+
+		if result.coverage != nil {
+			coverage[drive] = result.coverage
+		}
+
+		if result.identity != nil {
+			refreshIdentity(device, result.identity)
 		}
+		samples = append(samples, metricSample{
+			Name:   "smartctl_device_info",
+			Labels: infoLabels(device),
+			Value:  1,
+		})
 
 		if attrs == nil {
+			reason := "collection_failed"
+			if result.permissionDenied {
+				reason = "permission_denied"
+			}
+			deviceSkipped.WithLabelValues(reason).Inc()
+			deviceScrapeErrors.WithLabelValues(sanitizeLabelValue(drive)).Inc()
+			samples = append(samples, metricSample{
+				Name:   "smartctl_device_up",
+				Labels: deviceLabels(device),
+				Value:  0,
+			})
+			if result.panicked {
+				reason = "panic"
+			}
+			// A separate metric, a reason label on device_up would change
+			// its series whenever the drive goes down
+			downLabels := deviceLabels(device)
+			downLabels["reason"] = reason
+			samples = append(samples, metricSample{
+				Name:   "smartctl_device_down_reason",
+				Labels: downLabels,
+				Value:  1,
+			})
+			lastSamples[name] = append([]metricSample(nil), samples[first:]...)
 			continue
 		}
+		attrs["device_up"] = 1
+		attrs["device_collection_duration_seconds"] = result.duration.Seconds()
+		if device.CapacityBytes > 0 {
+			attrs["device_capacity_bytes"] = float64(device.CapacityBytes)
+		}
+		if rpm, ok := rotationRate(device); ok {
+			attrs["device_rotation_rate_rpm"] = float64(rpm)
+		}
+
+		// ATA drives count LBAs, convert them with the drive's logical block size
+		if device.LogicalBlockSize > 0 {
+			if lbas, ok := attrs["ata_lbas_read"]; ok {
+				attrs["host_read_bytes"] = lbas * float64(device.LogicalBlockSize)
+			}
+			if lbas, ok := attrs["ata_lbas_written"]; ok {
+				attrs["host_written_bytes"] = lbas * float64(device.LogicalBlockSize)
+			}
+		}
+
+		if reportWorstOver > 1 && matchesType(satTypes, typ) {
+			applyWorstOver(drive, attrs)
+		}
+
+		if eventWebhookURL != "" {
+			checkEvents(device, attrs)
+		}
+
+		if passed, ok := attrs["smart_passed"]; ok {
+			failed := passed == 0
+			if failed && !failedDevices[drive] && onFailureCommand != "" {
+				runOnFailureCommand(drive, device.SerialNumber)
+			}
+			failedDevices[drive] = failed
+		}
+
+		// In a stable order, so that of keys sanitizing to the same metric
+		// the same one is kept on every scrape
+		keys := make([]string, 0, len(attrs))
+		for key := range attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		labels := deviceLabels(device)
+		for _, key := range keys {
+			samples = append(samples, metricSample{
+				Name:   attributeMetricName(key),
+				Labels: labels,
+				Value:  attrs[key],
+			})
+		}
 
-		for key, value := range attrs {
-			metricName := sanitizeMetricName("smartctl_" + key)
-			if _, exists := metrics[metricName]; !exists {
-				desc := key
-				metrics[metricName] = prometheus.NewGaugeVec(
-					prometheus.GaugeOpts{
-						Name: metricName,
-						Help: desc,
-					},
-					labelNames,
-				)
-				prometheus.MustRegister(metrics[metricName])
+		for _, lv := range labeled {
+			merged := prometheus.Labels{}
+			for name, value := range labels {
+				merged[name] = value
 			}
+			for name, value := range lv.Labels {
+				merged[name] = value
+			}
+			samples = append(samples, metricSample{
+				Name:   attributeMetricName(lv.Name),
+				Labels: merged,
+				Value:  lv.Value,
+			})
+		}
+		lastSamples[name] = append([]metricSample(nil), samples[first:]...)
+	}
+
+	if controllerBBUCommand != "" {
+		collectControllerBBU()
+	}
+	collectionDuration.Set(time.Since(start).Seconds())
+	return samples, completed
+}
+
+// deviceLabels returns the labels identifying a device on each of its metrics.
+// The descriptive labels are only on smartctl_device_info, unless
+// --expose-info-labels asks for them everywhere.
+func deviceLabels(device *Device) prometheus.Labels {
+	if exposeInfoLabels {
+		return infoLabels(device)
+	}
+	labels := prometheus.Labels{
+		"drive": sanitizeLabelValue(device.Name),
+	}
+	if bayMap != nil {
+		labels["bay"] = lookupBay(device)
+	}
+	return labels
+}
+
+// infoLabels returns the labels of a device's smartctl_device_info metric.
+// bus_device and controller_id are empty unless the drive is a disk behind a
+// RAID controller.
+func infoLabels(device *Device) prometheus.Labels {
+	labels := prometheus.Labels{
+		"drive":            sanitizeLabelValue(device.Name),
+		"type":             device.Type,
+		"model_family":     device.ModelFamily,
+		"model_name":       device.ModelName,
+		"serial_number":    device.SerialNumber,
+		"firmware_version": device.FirmwareVersion,
+		"media_type":       mediaType(device),
+		"namespace":        device.Namespace,
+		"bus_device":       "",
+		"controller_id":    device.ControllerID,
+	}
+	if device.ControllerID != "" {
+		labels["bus_device"] = device.BusDevice
+	}
+	if bayMap != nil {
+		labels["bay"] = lookupBay(device)
+	}
+	return labels
+}
+
+// readDevice runs the smartctl commands for a device's type. It is called from
+// several goroutines at once and must not touch shared state.
+func readDevice(device *Device) deviceResult {
+	var result deviceResult
+	if device.PermissionDenied {
+		result.permissionDenied = true
+		return result
+	}
+	if debugCoverage {
+		result.coverage = newDeviceCoverage()
+	}
+	start := time.Now()
+
+	var output []byte
+	if device.ControllerID != "" {
+		result.attrs, result.labeled, output = smartController(device.BusDevice, device.Controller, device.ControllerID, result.coverage)
+	} else if matchesType(satTypes, device.Type) {
+		result.attrs, result.labeled, output = smartSat(device.BusDevice, device.Type, result.coverage)
+	} else if matchesType(nvmeTypes, device.Type) {
+		result.attrs, result.labeled, output = smartNvme(device.BusDevice, result.coverage)
+	} else if matchesType(scsiTypes, device.Type) {
+		result.attrs, result.labeled, output = smartScsi(device.BusDevice, result.coverage)
+	} else {
+		result.unknownType = true
+		return result
+	}
+	if result.attrs != nil {
+		result.identity = readIdentity(output)
+	}
+
+	result.duration = time.Since(start)
+
+	if result.coverage != nil {
+		result.coverage.finish(result.attrs, result.labeled)
+	}
+	return result
+}
+
+// collectControllerBBU runs --controller-bbu-command once for every RAID
+// controller bus device. smartctl itself can't report the battery state, so the
+// command (e.g. a storcli wrapper) must print 1 for a healthy battery or 0 for
+// a failed or missing one. Anything else leaves the metric unset, as does a
+// controller that is gone.
+func collectControllerBBU() {
+	seen := make(map[string]bool)
+	reported := make(map[string]bool)
+	defer func() {
+		for controller := range bbuReported {
+			if !reported[controller] {
+				controllerBBUStatus.DeleteLabelValues(controller)
+			}
+		}
+		bbuReported = reported
+		// Controllers whose disks are all gone
+		for controller := range bbuSeen {
+			if !seen[controller] {
+				controllerBBUTimeouts.DeleteLabelValues(controller)
+			}
+		}
+		bbuSeen = seen
+	}()
+
+	for _, device := range devices {
+		if device.ControllerID == "" || seen[device.BusDevice] {
+			continue
+		}
+		seen[device.BusDevice] = true
+
+		// Runs under the collection mutex, so it gets the smartctl timeout
+		command := controllerBBUCommand + " " + device.BusDevice
+		output, _, err := runCmd(controllerBBUCommand, []string{device.BusDevice})
+		if errors.Is(err, errTimedOut) {
+			controllerBBUTimeouts.WithLabelValues(device.BusDevice).Inc()
+		}
+		if err != nil {
+			slog.Warn("Controller BBU command failed", "command", command, "err", err)
+			continue
+		}
+		status, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+		if err != nil {
+			slog.Warn("Controller BBU command printed neither 0 nor 1", "command", command, "output", string(output))
+			continue
+		}
+		controllerBBUStatus.WithLabelValues(device.BusDevice).Set(status)
+		reported[device.BusDevice] = true
+	}
+}
+
+// collectionOrder returns device names in a stable order, with devices that
+// missed the previous cycle's deadline first.
+func collectionOrder() []string {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if deferred[names[i]] != deferred[names[j]] {
+			return deferred[names[i]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// runOnFailureCommand runs the --on-failure-command in the background with the
+// drive name and serial number as arguments.
+func runOnFailureCommand(drive, serial string) {
+	slog.Warn("Device failed its SMART health check, running the on-failure command", "device", drive, "serial", serial, "command", onFailureCommand)
+	go func() {
+		cmd := exec.Command(onFailureCommand, drive, serial)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			slog.Warn("On-failure command failed", "command", strings.Join(cmd.Args, " "), "err", err, "output", string(output))
+		}
+	}()
+}
+
+// Attributes whose worst value over --report-worst-over is the highest one:
+// counts of bad sectors or errors, temperatures and lifetime totals, such as
+// the raw values exported under their ataAttributesByID name.
+var worstIsHighest = map[string]bool{
+	"ata_current_pending_sectors": true,
+	"ata_offline_uncorrectable":   true,
+	"ata_error_log_count":         true,
+	"ata_lbas_written":            true,
+	"ata_lbas_read":               true,
+	"host_read_bytes":             true,
+	"host_written_bytes":          true,
+	// From the SCT status log, in degrees Celsius
+	"temperature_celsius": true,
+}
 
-			metrics[metricName].With(prometheus.Labels{
-                "drive":         sanitizeLabelValue(drive),
-                "type":          typ,
-				"model_family":  device.ModelFamily,
-				"model_name":    device.ModelName,
-				"serial_number": device.SerialNumber,
-				"user_capacity": device.UserCapacity,
-			}).Set(value)
+// Suffixes of the per-attribute keys smartSat exports, and whether the highest
+// value is the worst one. Longer suffixes come first. Keys without a listed
+// suffix are normalized values, where the lowest is the worst.
+var worstSuffixes = []struct {
+	suffix  string
+	highest bool
+}{
+	{"_raw_max", true},
+	{"_raw_min", false},
+	{"_raw", true},
+	{"_worst", false},
+}
+
+// Suffixes of keys left as they are, they are fixed per drive
+var worstIgnored = []string{"_threshold", "_prefail"}
+
+// worstHighest reports whether the highest value of an attribute is its worst.
+func worstHighest(key string) bool {
+	if worstIsHighest[key] {
+		return true
+	}
+	for _, s := range worstSuffixes {
+		if strings.HasSuffix(key, s.suffix) {
+			return s.highest
 		}
 	}
+	return false
+}
+
+// applyWorstOver replaces each ATA attribute with the worst value seen over the
+// last --report-worst-over collections, the highest or lowest one as
+// worstHighest says.
+func applyWorstOver(drive string, attrs map[string]float64) {
+	windows, ok := history[drive]
+	if !ok {
+		windows = make(map[string][]float64)
+		history[drive] = windows
+	}
+
+	for key, value := range attrs {
+		// device_* values describe the probe, such as the smartctl exit code
+		if strings.HasPrefix(key, "device_") {
+			continue
+		}
+		ignored := false
+		for _, suffix := range worstIgnored {
+			ignored = ignored || strings.HasSuffix(key, suffix)
+		}
+		if ignored {
+			continue
+		}
+		window := append(windows[key], value)
+		if len(window) > reportWorstOver {
+			window = window[len(window)-reportWorstOver:]
+		}
+		windows[key] = window
+
+		highest := worstHighest(key)
+		worst := window[0]
+		for _, v := range window[1:] {
+			if highest {
+				worst = math.Max(worst, v)
+			} else {
+				worst = math.Min(worst, v)
+			}
+		}
+		attrs[key] = worst
+	}
 }
 
 func parseAttributes(prefix string, data map[string]interface{}, attributes map[string]float64) {
@@ -287,6 +1417,10 @@ func parseAttributes(prefix string, data map[string]interface{}, attributes map[
         }
         switch v := value.(type) {
         case float64:
+            // The exact string form wins, see below
+            if _, ok := data[key+"_s"]; ok {
+                continue
+            }
             attributes[fullKey] = v
         case int:
             attributes[fullKey] = float64(v)
@@ -298,40 +1432,89 @@ func parseAttributes(prefix string, data map[string]interface{}, attributes map[
             }
         case map[string]interface{}:
             parseAttributes(fullKey, v, attributes)
+        case []interface{}:
+            parseArray(fullKey, v, attributes)
+        case string:
+            // Counters too large for a JSON number, such as 128-bit NVMe
+            // values, come as decimal strings. smartctl adds them next to the
+            // number with an _s suffix. float64 is only exact up to 2^53.
+            if identityFields[key] || !isDecimal(v) {
+                continue
+            }
+            value, err := strconv.ParseFloat(v, 64)
+            if err != nil {
+                continue
+            }
+            attributes[strings.TrimSuffix(fullKey, "_s")] = value
         }
     }
 }
 
-func smartMegaraid(dev, megaraidID string) map[string]float64 {
-    output, exitCode, err := runSmartctlCmd([]string{"-A", "-H", "-d", megaraidID, "--json=c", dev})
+// identityFields are strings in smartctl's output that can look like numbers
+// but identify the drive or smartctl rather than measure anything.
+var identityFields = map[string]bool{
+	"serial_number":      true,
+	"firmware_version":   true,
+	"svn_revision":       true,
+	"scsi_serial_number": true,
+	"scsi_revision":      true,
+}
+
+// isDecimal reports whether s is a non-negative decimal integer.
+func isDecimal(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseArray flattens array elements like object fields, keyed by their index:
+// temperature_sensors_0, temperature_sensors_1, ...
+func parseArray(prefix string, data []interface{}, attributes map[string]float64) {
+	for i, value := range data {
+		parseAttributes(prefix, map[string]interface{}{strconv.Itoa(i): value}, attributes)
+	}
+}
+
+func smartController(dev, controller, id string, cov *deviceCoverage) (map[string]float64, []labeledValue, []byte) {
+    output, exitCode, err := runCollectCmd(runControllerCmd, collectCommandArgs(controller, dev, id))
     if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
-        log.Println("Error running smartctl for MegaRAID:", err)
-        return nil
+        slog.Error("Error running smartctl for controller disk", "device", dev, "type", id, "err", err)
+        return nil, nil, nil
     }
 
+    cov.record(output)
+
     var result map[string]interface{}
     if err := json.Unmarshal(output, &result); err != nil {
-        log.Println("Error parsing MegaRAID JSON:", err)
-        return nil
+        slog.Error("Error parsing controller disk JSON", "device", dev, "type", id, "err", err)
+        return nil, nil, nil
     }
 
     attributes := make(map[string]float64)
+    var labeled []labeledValue
 
     // Determine device protocol
     deviceInfo, ok := result["device"].(map[string]interface{})
     if !ok {
-        log.Println("Cannot find device protocol")
-        return nil
+        slog.Error("Cannot find device protocol", "device", dev, "type", id)
+        return nil, nil, nil
     }
 
     protocol, ok := deviceInfo["protocol"].(string)
     if !ok {
-        log.Println("Cannot determine device protocol")
-        return nil
+        slog.Error("Cannot determine device protocol", "device", dev, "type", id)
+        return nil, nil, nil
     }
 
     if protocol == "ATA" {
-        // ATA device on MegaRAID
+        // ATA device behind the controller
+        temperatures := make(map[int]float64)
         if ataSmartAttributes, ok := result["ata_smart_attributes"].(map[string]interface{}); ok {
             if table, ok := ataSmartAttributes["table"].([]interface{}); ok {
                 for _, item := range table {
@@ -342,138 +1525,828 @@ func smartMegaraid(dev, megaraidID string) map[string]float64 {
                         rawString, _ := raw["string"].(string)
                         rawValue := parseRawValue(rawString)
 
-                        attributes[name] = value
-                        if rawValue != nil {
-                            attributes[name+"_raw"] = *rawValue
-                        }
-                    }
-                }
-            }
-        }
-    } else if protocol == "SCSI" {
-        // SCSI device on MegaRAID
-        // Recursively parse the JSON and extract all numeric values
-        parseAttributes("", result, attributes)
-    }
+                        id, _ := attr["id"].(float64)
+                        if (id == 190 || id == 194) && rawValue != nil {
+                            temperatures[int(id)] = *rawValue
+                        }
+                        if attributeExcluded(int(id), name) {
+                            continue
+                        }
+
+                        attributes[name] = value
+                        if rawValue != nil {
+                            attributes[name+"_raw"] = *rawValue
+                            if key, ok := ataAttributesByID[int(id)]; ok {
+                                attributes[key] = *rawValue
+                            }
+                        }
+                        if lowest, highest, ok := parseRawMinMax(rawString); ok {
+                            attributes[name+"_raw_min"] = lowest
+                            attributes[name+"_raw_max"] = highest
+                        }
+                        if worst, ok := attr["worst"].(float64); ok {
+                            attributes[name+"_worst"] = worst
+                        }
+                        if thresh, ok := attr["thresh"].(float64); ok {
+                            attributes[name+"_threshold"] = thresh
+                            labeled = append(labeled, attributeMargin(name, value, thresh))
+                        }
+                        if flags, ok := attr["flags"].(map[string]interface{}); ok {
+                            prefail, _ := flags["prefailure"].(bool)
+                            attributes[name+"_prefail"] = boolToFloat(prefail)
+                        }
+                        labeled = append(labeled, ataAttribute(int(id), name, value, rawValue)...)
+                    }
+                }
+            }
+        }
+        if temp, ok := ataTemperature(temperatures); ok {
+            attributes["device_temperature_celsius"] = temp
+        }
+    } else if protocol == "SCSI" {
+        // SCSI device behind the controller
+        // Recursively parse the JSON and extract all numeric values
+        dropIdentity(result)
+        parseAttributes("", result, attributes)
+        scsiHostBytes(result, attributes)
+        scsiGrownDefects(result, attributes)
+        scsiStartStopCycles(result, attributes)
+        labeled = append(labeled, scsiErrorCounters(result)...)
+    }
+
+    // Remove unnecessary keys
+    delete(attributes, "json_format_version")
+    delete(attributes, "smartctl")
+    delete(attributes, "device")
+    delete(attributes, "ata_smart_attributes")
+    delete(attributes, "scsi_grown_defect_list")
+    delete(attributes, "scsi_error_counter_log")
+    for key := range attributes {
+        if strings.HasPrefix(key, "scsi_error_counter_log_") {
+            delete(attributes, key)
+        }
+    }
+    delete(attributes, "smart_status")
+    delete(attributes, "smart_status_passed")
+    delete(attributes, "json_format_version_0")
+    delete(attributes, "json_format_version_1")
+    delete(attributes, "smartctl_version_0")
+    delete(attributes, "smartctl_version_1")
+
+    if passed, ok := smartStatusPassed(result); ok {
+        attributes["smart_passed"] = passed
+    }
+    if _, ok := attributes["device_temperature_celsius"]; !ok {
+        if temp, ok := currentTemperature(result); ok {
+            attributes["device_temperature_celsius"] = temp
+        }
+    }
+    powerCounters(result, attributes)
+    attributes["device_smartctl_exit_code"] = float64(exitCode)
+    return attributes, labeled, output
+}
+
+// smartSat reads ATA attributes using the device type found at discovery, so
+// that options such as the passthrough length in sat,12 are kept.
+func smartSat(dev, typ string, cov *deviceCoverage) (map[string]float64, []labeledValue, []byte) {
+	output, exitCode, err := runCollectCmd(runSmartctlCmd, collectCommandArgs("sat", dev, typ))
+    if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
+		slog.Error("Error running smartctl for SAT", "device", dev, "err", err)
+		return nil, nil, nil
+	}
+
+	cov.record(output)
+
+	var result struct {
+		AtaSmartAttributes struct {
+			Table []struct {
+				ID     int    `json:"id"`
+				Name   string `json:"name"`
+				Value  int    `json:"value"`
+				Worst  *int   `json:"worst"`
+				Thresh *int   `json:"thresh"`
+				Flags  *struct {
+					Prefailure bool `json:"prefailure"`
+				} `json:"flags"`
+				Raw struct {
+					String string `json:"string"`
+				} `json:"raw"`
+			} `json:"table"`
+		} `json:"ata_smart_attributes"`
+		// nil when the call didn't include -H or the drive has no SMART
+		SmartStatus *struct {
+			Passed bool `json:"passed"`
+		} `json:"smart_status"`
+		Temperature struct {
+			Current *float64 `json:"current"`
+		} `json:"temperature"`
+		PowerOnTime struct {
+			Hours *float64 `json:"hours"`
+		} `json:"power_on_time"`
+		PowerCycleCount *float64 `json:"power_cycle_count"`
+	}
+
+	if err := json.Unmarshal(output, &result); err != nil {
+		slog.Error("Error parsing SAT JSON", "device", dev, "err", err)
+		return nil, nil, nil
+	}
+
+	attributes := make(map[string]float64)
+	var labeled []labeledValue
+	hasTemperature := false
+	temperatures := make(map[int]float64)
+	for _, attr := range result.AtaSmartAttributes.Table {
+		if attr.ID == 190 || attr.ID == 194 {
+			hasTemperature = true
+			if raw := parseRawValue(attr.Raw.String); raw != nil {
+				temperatures[attr.ID] = *raw
+			}
+		}
+		if attributeExcluded(attr.ID, attr.Name) {
+			continue
+		}
+		name := attr.Name
+		value := float64(attr.Value)
+		rawValue := parseRawValue(attr.Raw.String)
+
+		attributes[name] = value
+		if rawValue != nil {
+			attributes[name+"_raw"] = *rawValue
+			if key, ok := ataAttributesByID[attr.ID]; ok {
+				attributes[key] = *rawValue
+			}
+		}
+		if lowest, highest, ok := parseRawMinMax(attr.Raw.String); ok {
+			attributes[name+"_raw_min"] = lowest
+			attributes[name+"_raw_max"] = highest
+		}
+		if attr.Worst != nil {
+			attributes[name+"_worst"] = float64(*attr.Worst)
+		}
+		if attr.Thresh != nil {
+			attributes[name+"_threshold"] = float64(*attr.Thresh)
+			labeled = append(labeled, attributeMargin(name, value, float64(*attr.Thresh)))
+		}
+		if attr.Flags != nil {
+			attributes[name+"_prefail"] = boolToFloat(attr.Flags.Prefailure)
+		}
+		labeled = append(labeled, ataAttribute(attr.ID, name, value, rawValue)...)
+	}
+
+	// Some drives report temperature only through the SCT status log
+	if !hasTemperature {
+		if result.Temperature.Current != nil {
+			attributes["temperature_celsius"] = *result.Temperature.Current
+		} else if temp := sctTemperature(dev, typ); temp != nil {
+			attributes["temperature_celsius"] = *temp
+		}
+	}
+	if temp, ok := ataTemperature(temperatures); ok {
+		attributes["device_temperature_celsius"] = temp
+	} else if result.Temperature.Current != nil {
+		attributes["device_temperature_celsius"] = *result.Temperature.Current
+	} else if temp, ok := attributes["temperature_celsius"]; ok && !hasTemperature {
+		attributes["device_temperature_celsius"] = temp
+	}
+
+	// Raw values such as "12345h+30m" don't parse, smartctl's own reading does
+	if _, ok := attributes["device_power_on_hours"]; !ok && result.PowerOnTime.Hours != nil {
+		attributes["device_power_on_hours"] = *result.PowerOnTime.Hours
+	}
+	if _, ok := attributes["device_power_cycle_count"]; !ok && result.PowerCycleCount != nil {
+		attributes["device_power_cycle_count"] = *result.PowerCycleCount
+	}
+
+	if ataErrorLog {
+		labeled = append(labeled, ataErrorsByType(dev, typ, attributes)...)
+	}
+
+	if selfTestProgress || selfTestLog {
+		ataSelfTest(dev, typ, attributes)
+	}
+
+	attributes["device_smartctl_exit_code"] = float64(exitCode)
+	if result.SmartStatus != nil {
+		attributes["smart_passed"] = boolToFloat(result.SmartStatus.Passed)
+	}
+	return attributes, labeled, output
+}
+
+// ataErrorTypes are the error register mnemonics smartctl prints in the error
+// description of the comprehensive ATA error log.
+var ataErrorTypes = []string{"ICRC", "UNC", "MC", "IDNF", "MCR", "ABRT", "NM", "AMNF", "TK0NF", "WP", "CCTO"}
+
+// ataErrorLogSection is the comprehensive or summary ATA error log as smartctl
+// reports it.
+type ataErrorLogSection struct {
+	Count *float64 `json:"count"`
+	Table []struct {
+		ErrorDescription string `json:"error_description"`
+	} `json:"table"`
+}
+
+// ataErrorsByType reads the comprehensive ATA error log and counts the logged
+// errors by type. Drives without it fall back to the summary error log, which
+// smartctl reads instead with -l xerror,error. An entry with several
+// mnemonics, such as "ICRC, ABRT", counts once for each. Media (UNC, IDNF),
+// interface (ICRC) and command (ABRT, timeout) errors point to different root
+// causes. The log only keeps the last entries, the number of errors the drive
+// ever logged goes to attributes.
+func ataErrorsByType(dev, typ string, attributes map[string]float64) []labeledValue {
+	output, exitCode, err := runSmartctlCmd([]string{"-l", "xerror,error", "-d", typ, "--json=c", dev})
+	if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
+		slog.Error("Error reading ATA error log", "device", dev, "err", err)
+		return nil
+	}
+
+	var result struct {
+		AtaSmartErrorLog struct {
+			Extended *ataErrorLogSection `json:"extended"`
+			Summary  *ataErrorLogSection `json:"summary"`
+		} `json:"ata_smart_error_log"`
+	}
+
+	if err := json.Unmarshal(output, &result); err != nil {
+		slog.Error("Error parsing ATA error log JSON", "device", dev, "err", err)
+		return nil
+	}
+
+	errorLog := result.AtaSmartErrorLog.Extended
+	if errorLog == nil {
+		errorLog = result.AtaSmartErrorLog.Summary
+	}
+	if errorLog == nil {
+		slog.Debug("Drive reported no ATA error log", "device", dev)
+		return nil
+	}
+	if errorLog.Count != nil {
+		attributes["ata_error_log_count"] = *errorLog.Count
+	}
+
+	counts := make(map[string]float64)
+	for _, errType := range ataErrorTypes {
+		counts[strings.ToLower(errType)] = 0
+	}
+	counts["timeout"] = 0
+	counts["other"] = 0
+
+	for _, entry := range errorLog.Table {
+		description := strings.TrimPrefix(entry.ErrorDescription, "Error: ")
+		// The mnemonics come first, e.g. "UNC 8 sectors at LBA = 0x..."
+		known := false
+		for _, word := range strings.FieldsFunc(description, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if contains(ataErrorTypes, word) {
+				counts[strings.ToLower(word)]++
+				known = true
+			}
+		}
+		lower := strings.ToLower(description)
+		if strings.Contains(lower, "timeout") || strings.Contains(lower, "timed out") {
+			counts["timeout"]++
+			known = true
+		}
+		if !known {
+			counts["other"]++
+		}
+	}
+
+	var labeled []labeledValue
+	for errType, count := range counts {
+		labeled = append(labeled, labeledValue{
+			Name:   "ata_error_by_type",
+			Labels: prometheus.Labels{"error_type": errType},
+			Value:  count,
+		})
+	}
+	return labeled
+}
+
+// ataSelfTest sets the progress of a running self-test with
+// --selftest-progress and the result of the last one with --selftest-log. One
+// smartctl call reads the capabilities and the self-test log as needed.
+func ataSelfTest(dev, typ string, attributes map[string]float64) {
+	var args []string
+	if selfTestProgress {
+		args = append(args, "-c")
+	}
+	if selfTestLog {
+		args = append(args, "-l", "selftest")
+	}
+	output, exitCode, err := runSmartctlCmd(append(args, "-d", typ, "--json=c", dev))
+	if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
+		slog.Error("Error reading ATA self-test status", "device", dev, "err", err)
+		return
+	}
 
-    // Remove unnecessary keys
-    delete(attributes, "json_format_version")
-    delete(attributes, "smartctl")
-    delete(attributes, "device")
-    delete(attributes, "ata_smart_attributes")
-    delete(attributes, "scsi_grown_defect_list")
-    delete(attributes, "scsi_error_counter_log")
-    delete(attributes, "smart_status")
+	var result struct {
+		AtaSmartData struct {
+			SelfTest struct {
+				Status struct {
+					RemainingPercent *float64 `json:"remaining_percent"`
+				} `json:"status"`
+			} `json:"self_test"`
+		} `json:"ata_smart_data"`
+		AtaSmartSelfTestLog struct {
+			Standard struct {
+				// Most recent first, empty when no self-test ever ran
+				Table []struct {
+					Status struct {
+						// Not set for aborted or interrupted tests
+						Passed *bool `json:"passed"`
+					} `json:"status"`
+					LifetimeHours *float64 `json:"lifetime_hours"`
+				} `json:"table"`
+			} `json:"standard"`
+		} `json:"ata_smart_self_test_log"`
+	}
 
-    return attributes
+	if err := json.Unmarshal(output, &result); err != nil {
+		slog.Error("Error parsing ATA self-test status JSON", "device", dev, "err", err)
+		return
+	}
+	if remaining := result.AtaSmartData.SelfTest.Status.RemainingPercent; remaining != nil {
+		attributes["device_selftest_progress_percent"] = 100 - *remaining
+	}
+	if table := result.AtaSmartSelfTestLog.Standard.Table; len(table) > 0 {
+		if table[0].Status.Passed != nil {
+			attributes["ata_self_test_passed"] = boolToFloat(*table[0].Status.Passed)
+		}
+		if table[0].LifetimeHours != nil {
+			attributes["ata_self_test_power_on_hours"] = *table[0].LifetimeHours
+		}
+	}
 }
 
-func smartSat(dev string) map[string]float64 {
-	output, exitCode, err := runSmartctlCmd([]string{"-A", "-H", "-d", "sat", "--json=c", dev})
-    if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
-		log.Println("Error running smartctl for SAT:", err)
+// sctTemperature reads the current temperature from the SCT status log.
+func sctTemperature(dev, typ string) *float64 {
+	output, exitCode, err := runSmartctlCmd([]string{"-l", "scttempsts", "-d", typ, "--json=c", dev})
+	if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
+		slog.Error("Error reading SCT temperature status", "device", dev, "err", err)
 		return nil
 	}
 
 	var result struct {
-		AtaSmartAttributes struct {
-			Table []struct {
-				ID    int    `json:"id"`
-				Name  string `json:"name"`
-				Value int    `json:"value"`
-				Raw   struct {
-					String string `json:"string"`
-				} `json:"raw"`
-			} `json:"table"`
-		} `json:"ata_smart_attributes"`
-		SmartStatus struct {
-			Passed bool `json:"passed"`
-		} `json:"smart_status"`
+		Temperature struct {
+			Current *float64 `json:"current"`
+		} `json:"temperature"`
 	}
 
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing SAT JSON:", err)
+		slog.Error("Error parsing SCT temperature JSON", "device", dev, "err", err)
 		return nil
 	}
+	return result.Temperature.Current
+}
+
+// nvmeHealth is the part of smartctl's NVMe output smartNvme reads.
+type nvmeHealth struct {
+	NvmeSmartHealthInformationLog map[string]interface{} `json:"nvme_smart_health_information_log"`
+	// nil when the call didn't include -H
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature struct {
+		Current *float64 `json:"current"`
+	} `json:"temperature"`
+}
+
+// readNvmeHealth runs the per-cycle smartctl call of an NVMe device.
+func readNvmeHealth(dev string) ([]byte, int, *nvmeHealth, error) {
+	output, exitCode, err := runCollectCmd(runSmartctlCmd, collectCommandArgs("nvme", dev, "nvme"))
+	if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
+		return nil, exitCode, nil, fmt.Errorf("error running smartctl for NVMe: %w", err)
+	}
+	var result nvmeHealth
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, exitCode, nil, fmt.Errorf("error parsing NVMe JSON: %w", err)
+	}
+	return output, exitCode, &result, nil
+}
+
+func smartNvme(dev string, cov *deviceCoverage) (map[string]float64, []labeledValue, []byte) {
+	output, exitCode, result, err := readNvmeHealth(dev)
+	// Some systems only return the full health log for the controller
+	// character device, not for the namespace the scan lists
+	if controller, _ := nvmeNamespace(dev); controller != "" && (result == nil || len(result.NvmeSmartHealthInformationLog) == 0) {
+		if controllerOutput, controllerExitCode, controllerResult, _ := readNvmeHealth(controller); controllerResult != nil && len(controllerResult.NvmeSmartHealthInformationLog) > 0 {
+			slog.Debug("Read the NVMe health log from the controller device", "device", dev, "path", controller)
+			dev, output, exitCode, result, err = controller, controllerOutput, controllerExitCode, controllerResult, nil
+		}
+	}
+	if err != nil {
+		slog.Error("Error reading NVMe health log", "device", dev, "err", err)
+		return nil, nil, nil
+	}
+
+	cov.record(output)
 
 	attributes := make(map[string]float64)
-	for _, attr := range result.AtaSmartAttributes.Table {
-		name := attr.Name
-		value := float64(attr.Value)
-		rawValue := parseRawValue(attr.Raw.String)
+    parseAttributes("", result.NvmeSmartHealthInformationLog, attributes)
+	// Exported with a sensor label by nvmeTemperatureSensors instead
+	for key := range attributes {
+		if strings.HasPrefix(key, "temperature_sensors_") {
+			delete(attributes, key)
+		}
+	}
+	for key, name := range nvmeAttributeNames {
+		if value, ok := attributes[key]; ok {
+			attributes[name] = value
+		}
+	}
+	minutesToSeconds(attributes)
+	// Wear and spare capacity are reported in percent
+	if used, ok := attributes["percentage_used"]; ok {
+		attributes["nvme_percentage_used_ratio"] = used / 100
+	}
+	if spare, ok := attributes["available_spare"]; ok {
+		attributes["nvme_available_spare_ratio"] = spare / 100
+		if threshold, ok := attributes["available_spare_threshold"]; ok {
+			attributes["nvme_available_spare_below_threshold"] = boolToFloat(spare < threshold)
+		}
+	}
+	// NVMe data units are thousands of 512-byte blocks
+	if units, ok := attributes["data_units_read"]; ok {
+		attributes["nvme_data_read_bytes"] = units * 512000
+		attributes["host_read_bytes"] = units * 512000
+	}
+	if units, ok := attributes["data_units_written"]; ok {
+		attributes["nvme_data_written_bytes"] = units * 512000
+		attributes["host_written_bytes"] = units * 512000
+	}
+	if selfTestProgress || selfTestLog {
+		nvmeSelfTest(dev, attributes)
+	}
+	attributes["device_smartctl_exit_code"] = float64(exitCode)
+	if result.Temperature.Current != nil {
+		attributes["device_temperature_celsius"] = *result.Temperature.Current
+	}
+	if result.SmartStatus != nil {
+		attributes["smart_passed"] = boolToFloat(result.SmartStatus.Passed)
+	}
+	labeled := nvmeTemperatureSensors(result.NvmeSmartHealthInformationLog)
+	labeled = append(labeled, nvmeCriticalWarnings(result.NvmeSmartHealthInformationLog)...)
+	return attributes, labeled, output
+}
 
-		attributes[name] = value
-		if rawValue != nil {
-			attributes[name+"_raw"] = *rawValue
+// nvmeCriticalWarningBits names the bits of the NVMe critical warning field.
+var nvmeCriticalWarningBits = []string{
+	"available_spare",
+	"temperature",
+	"reliability",
+	"read_only",
+	"volatile_memory_backup",
+	"persistent_memory_read_only",
+}
+
+// nvmeCriticalWarnings decodes the critical warning bitmask of the NVMe health
+// log into one 0 or 1 value per condition.
+func nvmeCriticalWarnings(healthLog map[string]interface{}) []labeledValue {
+	warning, ok := healthLog["critical_warning"].(float64)
+	if !ok {
+		return nil
+	}
+	var labeled []labeledValue
+	for i, bit := range nvmeCriticalWarningBits {
+		labeled = append(labeled, labeledValue{
+			Name:   "nvme_critical_warning",
+			Labels: prometheus.Labels{"bit": bit},
+			Value:  float64(int64(warning) >> i & 1),
+		})
+	}
+	return labeled
+}
+
+// nvmeTemperatureSensors returns the readings of the up to eight temperature
+// sensors in the NVMe health log, numbered from 1 as smartctl prints them.
+func nvmeTemperatureSensors(healthLog map[string]interface{}) []labeledValue {
+	sensors, _ := healthLog["temperature_sensors"].([]interface{})
+	var labeled []labeledValue
+	for i, sensor := range sensors {
+		value, ok := sensor.(float64)
+		if !ok {
+			continue
 		}
+		labeled = append(labeled, labeledValue{
+			Name:   "temperature_sensor_celsius",
+			Labels: prometheus.Labels{"sensor": strconv.Itoa(i + 1)},
+			Value:  value,
+		})
 	}
+	return labeled
+}
 
-	attributes["smart_passed"] = boolToFloat(result.SmartStatus.Passed)
-	return attributes
+// nvmeSelfTestLog is the NVMe self-test log as smartctl -l selftest prints it.
+type nvmeSelfTestLog struct {
+	CurrentSelfTestOperation struct {
+		Value int `json:"value"`
+	} `json:"current_self_test_operation"`
+	CurrentSelfTestCompletionPercent *float64 `json:"current_self_test_completion_percent"`
+	// Most recent first, empty when no self-test ever ran
+	Table []struct {
+		SelfTestResult struct {
+			Value int `json:"value"`
+		} `json:"self_test_result"`
+		PowerOnHours *float64 `json:"power_on_hours"`
+	} `json:"table"`
 }
 
-func smartNvme(dev string) map[string]float64 {
-	output, exitCode, err := runSmartctlCmd([]string{"-A", "-H", "-d", "nvme", "--json=c", dev})
-    if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
-		log.Println("Error running smartctl for NVMe:", err)
+// readNvmeSelfTestLog reads the self-test log of an NVMe drive, or returns nil
+// on error.
+func readNvmeSelfTestLog(dev string) *nvmeSelfTestLog {
+	output, exitCode, err := runSmartctlCmd([]string{"-l", "selftest", "-d", "nvme", "--json=c", dev})
+	if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
+		slog.Error("Error reading NVMe self-test log", "device", dev, "err", err)
 		return nil
 	}
 
 	var result struct {
-		NvmeSmartHealthInformationLog map[string]interface{} `json:"nvme_smart_health_information_log"`
-		SmartStatus                   struct {
-			Passed bool `json:"passed"`
-		} `json:"smart_status"`
+		NvmeSelfTestLog nvmeSelfTestLog `json:"nvme_self_test_log"`
 	}
 
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing NVMe JSON:", err)
+		slog.Error("Error parsing NVMe self-test log JSON", "device", dev, "err", err)
 		return nil
 	}
+	return &result.NvmeSelfTestLog
+}
 
-	attributes := make(map[string]float64)
-    parseAttributes("", result.NvmeSmartHealthInformationLog, attributes)
-	attributes["smart_passed"] = boolToFloat(result.SmartStatus.Passed)
-	return attributes
+// nvmeSelfTest sets the progress of a running self-test with
+// --selftest-progress and the result of the last one with --selftest-log,
+// from a single read of the self-test log.
+func nvmeSelfTest(dev string, attributes map[string]float64) {
+	testLog := readNvmeSelfTestLog(dev)
+	if testLog == nil {
+		return
+	}
+	if selfTestProgress && testLog.CurrentSelfTestOperation.Value != 0 && testLog.CurrentSelfTestCompletionPercent != nil {
+		attributes["device_selftest_progress_percent"] = *testLog.CurrentSelfTestCompletionPercent
+	}
+	if selfTestLog && len(testLog.Table) > 0 {
+		last := testLog.Table[0]
+		attributes["nvme_self_test_status"] = float64(last.SelfTestResult.Value)
+		if last.PowerOnHours != nil {
+			attributes["nvme_self_test_power_on_hours"] = *last.PowerOnHours
+		}
+	}
 }
 
-func smartScsi(dev string) map[string]float64 {
-	output, exitCode, err := runSmartctlCmd([]string{"-A", "-H", "-d", "scsi", "--json=c", dev})
+func smartScsi(dev string, cov *deviceCoverage) (map[string]float64, []labeledValue, []byte) {
+	output, exitCode, err := runCollectCmd(runSmartctlCmd, collectCommandArgs("scsi", dev, "scsi"))
     if err != nil && exitCode != 0 && exitCode != 2 && exitCode != 4 && exitCode != 6 {
-		log.Println("Error running smartctl for SCSI:", err)
-		return nil
+		slog.Error("Error running smartctl for SCSI", "device", dev, "err", err)
+		return nil, nil, nil
 	}
 
+	cov.record(output)
+
 	var result map[string]interface{}
 	if err := json.Unmarshal(output, &result); err != nil {
-		log.Println("Error parsing SCSI JSON:", err)
-		return nil
+		slog.Error("Error parsing SCSI JSON", "device", dev, "err", err)
+		return nil, nil, nil
 	}
 
 	attributes := make(map[string]float64)
+	dropIdentity(result)
     parseAttributes("", result, attributes)
+	scsiHostBytes(result, attributes)
+	scsiGrownDefects(result, attributes)
+	scsiStartStopCycles(result, attributes)
 
     // Remove unnecessary keys
     delete(attributes, "json_format_version")
     delete(attributes, "smartctl")
     delete(attributes, "device")
     delete(attributes, "smart_status")
+    delete(attributes, "smart_status_passed")
+    delete(attributes, "json_format_version_0")
+    delete(attributes, "json_format_version_1")
+    delete(attributes, "smartctl_version_0")
+    delete(attributes, "smartctl_version_1")
+	// Exported with operation and counter labels by scsiErrorCounters instead
+	for key := range attributes {
+		if strings.HasPrefix(key, "scsi_error_counter_log_") {
+			delete(attributes, key)
+		}
+	}
+
+	if passed, ok := smartStatusPassed(result); ok {
+		attributes["smart_passed"] = passed
+	}
+	if temp, ok := currentTemperature(result); ok {
+		attributes["device_temperature_celsius"] = temp
+	}
+	powerCounters(result, attributes)
+	attributes["device_smartctl_exit_code"] = float64(exitCode)
+	return attributes, scsiErrorCounters(result), output
+}
+
+// smartStatusPassed returns smart_status.passed from generically parsed
+// smartctl output. Drives without SMART support have no smart_status.
+func smartStatusPassed(result map[string]interface{}) (float64, bool) {
+	status, _ := result["smart_status"].(map[string]interface{})
+	passed, ok := status["passed"].(bool)
+	if !ok {
+		return 0, false
+	}
+	return boolToFloat(passed), true
+}
+
+// currentTemperature returns temperature.current from generically parsed
+// smartctl output, which smartctl fills in for every device type.
+func currentTemperature(result map[string]interface{}) (float64, bool) {
+	temperature, _ := result["temperature"].(map[string]interface{})
+	current, ok := temperature["current"].(float64)
+	return current, ok
+}
+
+// powerCounters sets device_power_on_hours and device_power_cycle_count from
+// the power_on_time and power_cycle_count smartctl reports for every device
+// type, unless an attribute already provided them.
+func powerCounters(result map[string]interface{}, attributes map[string]float64) {
+	powerOnTime, _ := result["power_on_time"].(map[string]interface{})
+	if hours, ok := powerOnTime["hours"].(float64); ok {
+		if _, exists := attributes["device_power_on_hours"]; !exists {
+			attributes["device_power_on_hours"] = hours
+		}
+	}
+	if cycles, ok := result["power_cycle_count"].(float64); ok {
+		if _, exists := attributes["device_power_cycle_count"]; !exists {
+			attributes["device_power_cycle_count"] = cycles
+		}
+	}
+}
+
+// scsiHostBytes derives host_read_bytes and host_written_bytes from the
+// gigabytes processed in the SCSI error counter log, when it was collected.
+func scsiHostBytes(result map[string]interface{}, attributes map[string]float64) {
+	counterLog, _ := result["scsi_error_counter_log"].(map[string]interface{})
+	for op, key := range map[string]string{"read": "host_read_bytes", "write": "host_written_bytes"} {
+		counters, _ := counterLog[op].(map[string]interface{})
+		// smartctl reports this as a decimal string, e.g. "1234.567"
+		switch gigabytes := counters["gigabytes_processed"].(type) {
+		case string:
+			if value, err := strconv.ParseFloat(gigabytes, 64); err == nil {
+				attributes[key] = value * 1e9
+			}
+		case float64:
+			attributes[key] = gigabytes * 1e9
+		}
+	}
+}
+
+// scsiStartStopCycles sets the accumulated start/stop and load/unload cycles
+// of a SCSI drive and the counts specified over its lifetime, so that they can
+// be compared for a wear ratio.
+func scsiStartStopCycles(result map[string]interface{}, attributes map[string]float64) {
+	counter, _ := result["scsi_start_stop_cycle_counter"].(map[string]interface{})
+	for field, key := range map[string]string{
+		"accumulated_start_stop_cycles":                    "scsi_start_stop_cycles",
+		"specified_cycle_count_over_device_lifetime":       "scsi_start_stop_cycles_specified",
+		"accumulated_load_unload_cycles":                   "scsi_load_unload_cycles",
+		"specified_load_unload_count_over_device_lifetime": "scsi_load_unload_cycles_specified",
+	} {
+		if value, ok := counter[field].(float64); ok {
+			attributes[key] = value
+		}
+	}
+}
+
+// scsiErrorCounters returns the counters of the SCSI error counter log, such
+// as errors corrected by ECC and total uncorrected errors, labeled with the
+// operation (read, write or verify) and the counter name. The gigabytes
+// processed are exported as host bytes by scsiHostBytes instead.
+func scsiErrorCounters(result map[string]interface{}) []labeledValue {
+	counterLog, _ := result["scsi_error_counter_log"].(map[string]interface{})
+	var labeled []labeledValue
+	for _, op := range []string{"read", "write", "verify"} {
+		counters, _ := counterLog[op].(map[string]interface{})
+		for counter, value := range counters {
+			count, ok := value.(float64)
+			if !ok {
+				continue
+			}
+			labeled = append(labeled, labeledValue{
+				Name:   "scsi_errors",
+				Labels: prometheus.Labels{"operation": op, "counter": counter},
+				Value:  count,
+			})
+		}
+	}
+	return labeled
+}
+
+// scsiGrownDefects sets scsi_grown_defect_list_count from the grown defect
+// list, the sectors the drive remapped since it left the factory. A rising
+// count is a primary SCSI failure predictor.
+func scsiGrownDefects(result map[string]interface{}, attributes map[string]float64) {
+	if defects, ok := result["scsi_grown_defect_list"].(float64); ok {
+		attributes["scsi_grown_defect_list_count"] = defects
+	}
+}
+
+// attributeMargin returns how far an ATA attribute's normalized value is above
+// its failure threshold. A shrinking margin predicts failure.
+func attributeMargin(name string, value, thresh float64) labeledValue {
+	return labeledValue{
+		Name:   "ata_attribute_margin",
+		Labels: prometheus.Labels{"name": name},
+		Value:  value - thresh,
+	}
+}
+
+// ataAttribute returns an ATA attribute's normalized and raw value labeled
+// with its ID, which stays the same when vendors name the attribute
+// differently.
+func ataAttribute(id int, name string, value float64, rawValue *float64) []labeledValue {
+	labels := prometheus.Labels{"id": strconv.Itoa(id), "name": name}
+	labeled := []labeledValue{{Name: "ata_attribute", Labels: labels, Value: value}}
+	if rawValue != nil {
+		labeled = append(labeled, labeledValue{Name: "ata_attribute_raw", Labels: labels, Value: *rawValue})
+	}
+	return labeled
+}
+
+// addExcludedAttribute parses an --exclude-attribute value: an attribute ID,
+// a range of IDs such as 170-179, or an attribute name.
+func addExcludedAttribute(value string) error {
+	if from, to, ok := strings.Cut(value, "-"); ok {
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(to)
+		if err1 == nil && err2 == nil {
+			if first > last {
+				return fmt.Errorf("invalid --exclude-attribute range %q", value)
+			}
+			for id := first; id <= last; id++ {
+				excludedAttributeIDs[id] = true
+			}
+			return nil
+		}
+	}
+	if id, err := strconv.Atoi(value); err == nil {
+		excludedAttributeIDs[id] = true
+		return nil
+	}
+	excludedAttributeNames[strings.ToLower(value)] = true
+	return nil
+}
 
-	return attributes
+// attributeExcluded reports whether an ATA attribute was dropped with
+// --exclude-attribute, by ID or case-insensitively by name.
+func attributeExcluded(id int, name string) bool {
+	return excludedAttributeIDs[id] || excludedAttributeNames[strings.ToLower(name)]
 }
 
+// groupedNumberRegexp matches integers with comma thousands separators, e.g.
+// "1,234,567".
+var groupedNumberRegexp = regexp.MustCompile(`^-?\d{1,3}(,\d{3})+$`)
+
+// parseRawValue returns the number at the start of an ATA raw value string,
+// ignoring any text after it: "37 (Min/Max 20/45)" is 37. Integers grouped with
+// commas such as "1,234" are read whole. It returns nil for an empty string or
+// one not starting with a decimal number, such as hex values.
 func parseRawValue(rawStr string) *float64 {
 	parts := strings.Fields(rawStr)
 	if len(parts) == 0 {
 		return nil
 	}
-	value, err := strconv.ParseFloat(parts[0], 64)
+	number := parts[0]
+	if groupedNumberRegexp.MatchString(number) {
+		number = strings.ReplaceAll(number, ",", "")
+	}
+	value, err := strconv.ParseFloat(number, 64)
 	if err != nil {
 		return nil
 	}
 	return &value
 }
 
+// rawMinMaxRegexp matches the lifetime range some drives append to a raw
+// temperature, e.g. "37 (Min/Max 20/45)".
+var rawMinMaxRegexp = regexp.MustCompile(`\(Min/Max (-?\d+)/(-?\d+)`)
+
+// ataTemperature picks the drive temperature from the raw values of ATA
+// attributes 194 (Temperature_Celsius) and 190 (Airflow_Temperature_Cel), by ID
+// since vendors name them differently.
+func ataTemperature(temperatures map[int]float64) (float64, bool) {
+	if temp, ok := temperatures[194]; ok {
+		return temp, true
+	}
+	temp, ok := temperatures[190]
+	return temp, ok
+}
+
+// parseRawMinMax returns the minimum and maximum embedded in a raw value
+// string, if any.
+func parseRawMinMax(rawStr string) (float64, float64, bool) {
+	matches := rawMinMaxRegexp.FindStringSubmatch(rawStr)
+	if matches == nil {
+		return 0, 0, false
+	}
+	lowest, _ := strconv.ParseFloat(matches[1], 64)
+	highest, _ := strconv.ParseFloat(matches[2], 64)
+	return lowest, highest, true
+}
+
 func boolToFloat(b bool) float64 {
 	if b {
 		return 1
@@ -481,6 +2354,16 @@ func boolToFloat(b bool) float64 {
 	return 0
 }
 
+var (
+	invalidMetricCharsRegexp = regexp.MustCompile(`[^a-z0-9_:]`)
+	repeatedUnderscoreRegexp = regexp.MustCompile(`__+`)
+)
+
+// sanitizeMetricName turns an attribute name into a valid metric name part:
+// lowercase, with separators turned into single underscores and any other
+// character outside [a-z0-9_:] dropped, as vendors name attributes freely.
+// Underscores at either end are dropped too, the part follows the smartctl_
+// prefix, which also makes parts starting with a digit valid.
 func sanitizeMetricName(name string) string {
 	replacer := strings.NewReplacer(
 		"-", "_",
@@ -488,7 +2371,9 @@ func sanitizeMetricName(name string) string {
 		".", "",
 		"/", "_",
 	)
-	return strings.ToLower(replacer.Replace(name))
+	name = invalidMetricCharsRegexp.ReplaceAllString(strings.ToLower(replacer.Replace(name)), "")
+	name = repeatedUnderscoreRegexp.ReplaceAllString(name, "_")
+	return strings.Trim(name, "_")
 }
 
 func sanitizeLabelValue(value string) string {
@@ -501,6 +2386,13 @@ func sanitizeLabelValue(value string) string {
 	return replacer.Replace(value)
 }
 
+// matchesType reports whether a smartctl device type belongs to one of the
+// given base types, ignoring options such as the passthrough length in sat,12.
+func matchesType(types []string, typ string) bool {
+	base, _, _ := strings.Cut(typ, ",")
+	return contains(types, base)
+}
+
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
 		if s == item {
@@ -510,17 +2402,110 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
+// listen binds the HTTP port. With --port-fallback, a busy port is retried on
+// the next few ports and finally on a random free port. An address of the form
+// unix:/path listens on that Unix socket instead, ignoring the port.
+func listen(address, port string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return listenUnix(path)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", address, port))
+	if err == nil || !portFallback || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+
+	candidates := []string{}
+	if p, convErr := strconv.Atoi(port); convErr == nil {
+		for i := 1; i <= 10; i++ {
+			candidates = append(candidates, strconv.Itoa(p+i))
+		}
+	}
+	candidates = append(candidates, "0")
+
+	for _, candidate := range candidates {
+		slog.Warn("Port is in use, trying the next one", "port", port, "next", candidate)
+		if listener, fallbackErr := net.Listen("tcp", fmt.Sprintf("%s:%s", address, candidate)); fallbackErr == nil {
+			return listener, nil
+		}
+	}
+	return nil, err
+}
+
+// listenUnix listens on a Unix socket with --unix-socket-mode permissions,
+// replacing the socket a previous run may have left behind. Closing the
+// listener on shutdown removes the socket file.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
 func main() {
 
 	envAddress := os.Getenv("SMARTCTL_EXPORTER_ADDRESS")
 	envPort := os.Getenv("SMARTCTL_EXPORTER_PORT")
 	envIntervalStr := os.Getenv("SMARTCTL_REFRESH_INTERVAL")
+	envSmartctlPath := os.Getenv("SMARTCTL_EXPORTER_SMARTCTL_PATH")
+	envAuthToken := os.Getenv("SMARTCTL_EXPORTER_AUTH_TOKEN")
 
     // Define flags using pflag
 	showVersion := pflag.Bool("version", false, "Show the version and exit")
+	configFile := pflag.String("config-file", "", "YAML file with settings, overridden by flags and environment variables")
 	flagAddress := pflag.String("address", "", "Address to listen on")
 	flagPort := pflag.String("port", "", "Port to listen on")
-	flagInterval := pflag.Int("interval", 0, "Refresh interval in seconds")
+	socketMode := pflag.String("unix-socket-mode", "0660", "Permissions of the socket when --address is unix:/path")
+	prefix := pflag.String("metric-prefix", "smartctl", "Prefix of the device metric names, e.g. storage_smartctl")
+	telemetryPath := pflag.String("web.telemetry-path", "/metrics", "Path to serve the metrics on")
+	flagInterval := pflag.Int("interval", 60, "Seconds to cache SMART data between scrapes (0 reads the drives on every scrape)")
+	flagSmartctlPath := pflag.String("smartctl-path", "", "Path to the smartctl binary")
+	flagAuthToken := pflag.String("auth-token", "", "Require this token in an \"Authorization: Bearer\" header")
+	pflag.BoolVar(&portFallback, "port-fallback", false, "Try the next ports, then a random one, when the port is in use")
+	pflag.BoolVar(&counterTypes, "counter-types", false, "Export known-monotonic metrics as _total counters")
+	pflag.IntVar(&reportWorstOver, "report-worst-over", 0, "Report the worst ATA attribute value seen over the last N collections")
+	pflag.StringVar(&onFailureCommand, "on-failure-command", "", "Command to run with the drive name and serial when a drive fails its health check")
+	pflag.StringVar(&duplicateDevices, "duplicate-devices", "suffix", "How to handle devices with the same name: suffix or skip")
+	pflag.StringVar(&controllerBBUCommand, "controller-bbu-command", "", "Command printing 1 or 0 for the battery status of the RAID controller given as argument")
+	pflag.StringVar(&controllerCommand, "controller-command", "", "Command run instead of smartctl for drives behind RAID controllers")
+	pflag.DurationVar(&smartctlTimeout, "smartctl-timeout", smartctlTimeout, "Kill smartctl commands running longer than this (0 disables)")
+	pflag.DurationVar(&rescanInterval, "rescan-interval", rescanInterval, "Time between device rescans picking up added and removed drives (0 disables)")
+	pflag.IntVar(&concurrency, "concurrency", concurrency, "Number of devices to read at the same time")
+	pflag.DurationVar(&cycleDeadline, "cycle-deadline", 0, "Skip devices not reached within this time of the cycle start, collecting them first next cycle (0 disables)")
+	pflag.StringVar(&eventWebhookURL, "event-webhook-url", "", "URL to POST a JSON event to on health changes and watched threshold crossings")
+	eventWatchFlags := pflag.StringArray("event-watch", nil, "Attribute threshold to send events for, as name=threshold (repeatable)")
+	pflag.DurationVar(&eventDebounce, "event-debounce", eventDebounce, "Minimum time between identical events")
+	pflag.BoolVar(&ataErrorLog, "ata-error-log", false, "Export the ATA error count and the errors in the comprehensive error log by type (one extra smartctl call per drive)")
+	pflag.BoolVar(&selfTestProgress, "selftest-progress", false, "Export the progress of running self-tests on ATA and NVMe drives (one extra smartctl call per drive)")
+	pflag.BoolVar(&selfTestLog, "selftest-log", false, "Export the result of the last self-test on ATA and NVMe drives (one extra smartctl call per drive)")
+	pflag.BoolVar(&debugCoverage, "debug-coverage", false, "Serve /debug/coverage with the smartctl JSON fields each device reported and exported")
+	pflag.BoolVar(&selfTestAPI, "enable-selftest-api", false, "Serve POST /selftest?device=...&type=short|long|conveyance to start self-tests (requires an auth token)")
+	pflag.BoolVar(&debugSmartctl, "debug-smartctl", false, "Serve /debug/smartctl?device=... with the raw smartctl JSON of a device")
+	logFormat := pflag.String("log-format", "text", "Log format: text or json")
+	logLevel := pflag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	debug := pflag.Bool("debug", false, "Same as --log-level debug")
+	pflag.BoolVar(&quietDiscovery, "quiet-discovery", false, "Don't log each discovered device")
+	includeDeviceFlags := pflag.StringArray("include-device", nil, "Only probe devices matching this glob, or regular expression prefixed with regex: (repeatable)")
+	excludeDeviceFlags := pflag.StringArray("exclude-device", nil, "Never probe devices matching this glob, or regular expression prefixed with regex:, even if included (repeatable)")
+	pflag.BoolVar(&exposeInfoLabels, "expose-info-labels", false, "Put the type, model and serial number labels on every metric, not only on smartctl_device_info")
+	pflag.BoolVar(&includeGoMetrics, "include-go-metrics", false, "Also export the go_* runtime and process_* metrics of the exporter")
+	pflag.StringVar(&inputDir, "input-dir", "", "Read smartctl -x --json output captured per device from this directory instead of running smartctl")
+	pflag.StringArrayVar(&scanArgs, "scan-arg", nil, "Argument appended to the smartctl --scan-open command, e.g. -d sat, or --scan to replace --scan-open (repeatable)")
+	pflag.BoolVar(&noScan, "no-scan", false, "Don't scan for devices, only probe the --device entries")
+	deviceFlags := pflag.StringArray("device", nil, "Device to probe even if the scan doesn't list it, as path:type, e.g. /dev/sdb:sat (repeatable)")
+	excludeAttributeFlags := pflag.StringSlice("exclude-attribute", nil, "ATA attribute ID, ID range (170-179) or name to drop from every drive (repeatable)")
+	collectArgsFlags := pflag.StringArray("collect-args", nil, "smartctl arguments for a device class (sat, nvme, scsi, megaraid, aacraid, areca, 3ware, cciss), as class=template (repeatable)")
+	hostname, _ := os.Hostname()
+	nodeName := pflag.String("node-name", hostname, "Value of the node label on every metric, empty to leave the label out")
+	labelFlags := pflag.StringArray("label", nil, "Label added to every metric, as key=value, e.g. datacenter=fra1 (repeatable)")
+	bayMapFile := pflag.String("bay-map-file", "", "File mapping drive serial numbers or WWNs to bay identifiers")
 
 	pflag.Parse()
 
@@ -529,12 +2514,137 @@ func main() {
 		return
 	}
 
+	if *debug {
+		*logLevel = "debug"
+	}
+	logger, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		fatal("Invalid logging flags", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cmdContext = ctx
+
+	config := &fileConfig{}
+	if *configFile != "" {
+		if config, err = loadConfig(*configFile); err != nil {
+			fatal("Error loading config file", "err", err)
+		}
+	}
+
+	if concurrency < 1 {
+		fatal("Invalid --concurrency value, expected at least 1", "value", concurrency)
+	}
+
+	if duplicateDevices != "suffix" && duplicateDevices != "skip" {
+		fatal("Invalid --duplicate-devices value, expected suffix or skip", "value", duplicateDevices)
+	}
+
+	deviceValues := *deviceFlags
+	if len(deviceValues) == 0 {
+		deviceValues = config.Devices
+	}
+	for _, value := range deviceValues {
+		device, err := parseStaticDevice(value)
+		if err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+		staticDevices = append(staticDevices, device)
+	}
+
+	if noScan && len(staticDevices) == 0 {
+		fatal("--no-scan needs at least one --device")
+	}
+
+	includePatterns := *includeDeviceFlags
+	if len(includePatterns) == 0 {
+		includePatterns = config.IncludeDevices
+	}
+	for _, value := range includePatterns {
+		pattern, err := parseDevicePattern(value)
+		if err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+		includeDevices = append(includeDevices, pattern)
+	}
+
+	excludePatterns := *excludeDeviceFlags
+	if len(excludePatterns) == 0 {
+		excludePatterns = config.ExcludeDevices
+	}
+	for _, value := range excludePatterns {
+		pattern, err := parseDevicePattern(value)
+		if err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+		excludeDevices = append(excludeDevices, pattern)
+	}
+
+	if mode, err := strconv.ParseUint(*socketMode, 8, 32); err != nil || mode > 0777 {
+		fatal("Invalid flag value", "err", fmt.Errorf("--unix-socket-mode %q isn't an octal permission mode", *socketMode))
+	} else {
+		unixSocketMode = os.FileMode(mode)
+	}
+
+	metricPrefix = sanitizeMetricName(*prefix)
+	if metricPrefix == "" || metricPrefix[0] >= '0' && metricPrefix[0] <= '9' {
+		fatal("Invalid flag value", "err", fmt.Errorf("--metric-prefix %q doesn't start with a letter", *prefix))
+	}
+
+	if !strings.HasPrefix(*telemetryPath, "/") {
+		fatal("Invalid flag value", "err", fmt.Errorf("--web.telemetry-path %q doesn't start with /", *telemetryPath))
+	}
+
+	for _, value := range *excludeAttributeFlags {
+		if err := addExcludedAttribute(value); err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+	}
+
+	for _, value := range *collectArgsFlags {
+		if err := setCollectArgs(value); err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+	}
+
+	for _, value := range *labelFlags {
+		if err := addExtraLabel(value); err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+	}
+	// Drive names such as /dev/sda repeat on every host, the node tells them apart
+	if *nodeName != "" {
+		if _, set := extraLabels["node"]; set {
+			fatal("Invalid flag value", "err", fmt.Errorf("--label node=... conflicts with --node-name, set --node-name instead"))
+		}
+		extraLabels["node"] = *nodeName
+	}
+
+	for _, watch := range *eventWatchFlags {
+		name, threshold, err := parseEventWatch(watch)
+		if err != nil {
+			fatal("Invalid flag value", "err", err)
+		}
+		eventWatches[name] = threshold
+	}
+
+	if *bayMapFile != "" {
+		var err error
+		if bayMap, err = loadBayMap(*bayMapFile); err != nil {
+			fatal("Error loading bay map", "err", err)
+		}
+	}
+
     // Set default values
 	address := "0.0.0.0"
 	if *flagAddress != "" {
 		address = *flagAddress
 	} else if envAddress != "" {
 		address = envAddress
+	} else if config.Address != "" {
+		address = config.Address
 	}
 
 	port := "9809"
@@ -542,36 +2652,160 @@ func main() {
 		port = *flagPort
 	} else if envPort != "" {
 		port = envPort
+	} else if config.Port != "" {
+		port = config.Port
 	}
 
 	refreshInterval := 60
-	if *flagInterval != 0 {
+	if pflag.CommandLine.Changed("interval") {
 		refreshInterval = *flagInterval
 	} else if envIntervalStr != "" {
 		if val, err := strconv.Atoi(envIntervalStr); err == nil {
 			refreshInterval = val
 		}
+	} else if config.Interval != nil {
+		refreshInterval = *config.Interval
+	}
+
+	if *flagSmartctlPath != "" {
+		smartctlPath = *flagSmartctlPath
+	} else if envSmartctlPath != "" {
+		smartctlPath = envSmartctlPath
+	} else if config.SmartctlPath != "" {
+		smartctlPath = config.SmartctlPath
+	}
+	if *flagAuthToken != "" {
+		authToken = *flagAuthToken
+	} else if envAuthToken != "" {
+		authToken = envAuthToken
+	}
+	// Starting self-tests changes the drives, never allow it anonymously
+	if selfTestAPI && authToken == "" {
+		fatal("--enable-selftest-api requires an auth token")
+	}
+
+	detectedVersion := "unknown"
+	if inputDir != "" {
+		if _, err := readInputFiles(); err != nil {
+			fatal("Error reading --input-dir", "err", err)
+		}
+		smartctlRunner = inputDirRunner{}
+	} else {
+		smartctlRunner = commandRunner{path: smartctlPath}
+		if controllerCommand != "" {
+			controllerRunner = commandRunner{path: controllerCommand}
+		}
+		if _, err := exec.LookPath(smartctlPath); err != nil {
+			fatal("smartctl binary not found or not executable", "path", smartctlPath, "err", err)
+		}
+		detectedVersion = smartctlVersion()
+	}
+	if detectedVersion == "unknown" && inputDir == "" {
+		slog.Warn("Cannot tell the smartctl version, assuming it supports JSON output", "path", smartctlPath)
+	} else if smartctlTooOld(detectedVersion) {
+		fatal("smartctl is too old to print JSON, upgrade smartmontools", "version", detectedVersion, "minimum", minSmartctlVersion)
 	}
+	buildInfo.WithLabelValues(version, runtime.Version(), detectedVersion).Set(1)
 
     // Initialize devices
 	devices = getDrives()
+	trackPresence(devices)
+
+	if rescanInterval > 0 {
+		go func() {
+			for range time.Tick(rescanInterval) {
+				if added, removed := rescan(); added > 0 || removed > 0 {
+					slog.Info("Device rescan found changes", "added", added, "removed", removed)
+				}
+			}
+		}()
+	}
 
-    // Run HTTP server
-	http.Handle("/metrics", promhttp.Handler())
-	serverAddress := fmt.Sprintf("%s:%s", address, port)
-	log.Printf("Server listening on http://%s/metrics", serverAddress)
+	// Rescan right away on SIGHUP, e.g. after inserting a disk
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := http.ListenAndServe(serverAddress, nil); err != nil {
-			log.Fatal(err)
+		for range hup {
+			added, removed := rescan()
+			slog.Info("Rescanned devices on SIGHUP", "added", added, "removed", removed)
 		}
 	}()
 
-    // Start metrics collection cycle
-	ticker := time.NewTicker(time.Duration(refreshInterval) * time.Second)
-	defer ticker.Stop()
+	// Collect once right away, so that /readyz doesn't wait for the first scrape
+	collector := newSmartCollector(time.Duration(refreshInterval) * time.Second)
+	go collector.refresh()
+
+	// Collectors registered through this carry the --label values
+	registerer := prometheus.WrapRegistererWith(extraLabels, registry)
+	if includeGoMetrics {
+		registerer.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	// Metrics about the devices take the --metric-prefix like the device
+	// metrics, those about the exporter keep theirs
+	prometheus.WrapRegistererWithPrefix(metricPrefix+"_", registerer).MustRegister(
+		deviceSkipped,
+		presenceFlaps,
+		deviceOpenError,
+		controllerBBUStatus,
+		controllerBBUTimeouts,
+		collectionTimeouts,
+	)
+	registerer.MustRegister(
+		cycleOverruns,
+		buildInfo,
+		collectionDuration,
+		exporterUp,
+		scrapeCycles,
+		deviceScrapeErrors,
+		smartctlInvocations,
+		metricRegistrationErrors,
+		collector,
+	)
+
+    // Run HTTP server
+	http.Handle(*telemetryPath, requireToken(metricsHandler(registry)))
+	http.Handle("/device", requireToken(http.HandlerFunc(deviceHandler)))
+	// Probes carry no credentials and learn nothing about the drives
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	if debugCoverage {
+		http.Handle("/debug/coverage", requireToken(http.HandlerFunc(coverageHandler)))
+	}
+	if debugSmartctl {
+		http.Handle("/debug/smartctl", requireToken(http.HandlerFunc(smartctlHandler)))
+	}
+	if selfTestAPI {
+		http.Handle("/selftest", requireToken(http.HandlerFunc(selfTestHandler)))
+	}
+	listener, err := listen(address, port)
+	if err != nil {
+		fatal("Error listening", "err", err)
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		// Report the configured address with the port actually bound
+		serverAddress := fmt.Sprintf("%s:%d", address, addr.Port)
+		slog.Info("Server listening", "url", "http://"+serverAddress+*telemetryPath)
+	} else {
+		slog.Info("Server listening", "socket", listener.Addr().String(), "path", *telemetryPath)
+	}
+
+	server := &http.Server{}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fatal("HTTP server stopped", "err", err)
+		}
+	}()
 
-	for {
-		collect()
-		<-ticker.C
+	// Drain in-flight scrapes on SIGTERM or SIGINT. Their smartctl commands
+	// were killed when ctx was cancelled, so this doesn't wait for the drives.
+	<-ctx.Done()
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Error shutting down the HTTP server", "err", err)
 	}
 }
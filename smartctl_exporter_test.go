@@ -0,0 +1,716 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+func TestParseRawValue(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want *float64
+	}{
+		{"empty", "", nil},
+		{"blank", "   ", nil},
+		{"integer", "12345", float(12345)},
+		{"float", "12.5", float(12.5)},
+		{"trailing text", "37 (Min/Max 20/45)", float(37)},
+		{"grouped", "1,234", float(1234)},
+		{"grouped millions", "1,234,567", float(1234567)},
+		{"comma not grouping", "12,5", nil},
+		{"negative", "-5", float(-5)},
+		{"negative grouped", "-1,234", float(-1234)},
+		{"hex", "0x0000000a", nil},
+		{"text", "Unknown", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRawValue(tt.raw)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil:
+				t.Errorf("parseRawValue(%q) = %v, want %v", tt.raw, deref(got), deref(tt.want))
+			case *got != *tt.want:
+				t.Errorf("parseRawValue(%q) = %v, want %v", tt.raw, *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeMetricName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"Raw_Read_Error_Rate", "smartctl_raw_read_error_rate"},
+		{"Power-On Hours", "smartctl_power_on_hours"},
+		{"Head Flying Hours/Pct", "smartctl_head_flying_hours_pct"},
+		{"Spin.Retry.Count", "smartctl_spinretrycount"},
+		{"123", "smartctl_123"},
+		{"1st_Attribute", "smartctl_1st_attribute"},
+		{"_leading", "smartctl_leading"},
+		{"trailing__", "smartctl_trailing"},
+		{"a -- b", "smartctl_a_b"},
+		{"Temp (°C)", "smartctl_temp_c"},
+		{"Wear%Level!", "smartctl_wearlevel"},
+		{"vendor:field", "smartctl_vendor:field"},
+		{"???", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := attributeMetricName(tt.key)
+		if got != tt.want {
+			t.Errorf("attributeMetricName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if got != "" && !model.IsValidMetricName(model.LabelValue(got)) {
+			t.Errorf("attributeMetricName(%q) = %q, not a valid metric name", tt.key, got)
+		}
+	}
+}
+
+func TestCommandDrive(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-a", "-d", "sat", "--json=c", "/dev/sda"}, "_dev_sda"},
+		{[]string{"-l", "scttempsts", "-d", "sat", "--json=c", "/dev/sdb"}, "_dev_sdb"},
+		{[]string{"-a", "-d", "megaraid,5", "--json=c", "/dev/bus/0"}, "_dev_bus_0_megaraid_5"},
+		{[]string{"--scan-open", "--json=c"}, ""},
+		{[]string{"--scan-open", "--json=c", "-d", "sat"}, ""},
+		{[]string{"--json=c", "--scan", "-d", "nvme"}, ""},
+		{[]string{"--version"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := commandDrive(tt.args); got != tt.want {
+			t.Errorf("commandDrive(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// deref formats an optional value for test failures.
+func deref(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func TestGetDrivesSharedControllerPath(t *testing.T) {
+	// Two HBAs whose scans both list a disk at /dev/bus/0 -d megaraid,0
+	info := `{"device":{"protocol":"ATA"},"model_name":"ST4000NM0035","serial_number":"%s"}`
+	useRunners(t, fakeRunner{
+		"--scan-open --json=c": `{"devices":[
+			{"name":"/dev/bus/0","type":"megaraid,0"},
+			{"name":"/dev/bus/0","type":"sat+megaraid,0"},
+			{"name":"/dev/bus/0","type":"megaraid,1"}]}`,
+		strings.Join(collectCommandArgs("megaraid", "/dev/bus/0", "megaraid,0"), " "): fmt.Sprintf(info, "ZC1"),
+		strings.Join(collectCommandArgs("megaraid", "/dev/bus/0", "megaraid,1"), " "): fmt.Sprintf(info, "ZC2"),
+	}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{}
+	t.Cleanup(func() { devices = savedDevices })
+
+	before := testCounterValue(t, deviceSkipped.WithLabelValues("duplicate"))
+	disks := getDrives()
+	var names []string
+	for name, device := range disks {
+		if device.Name != name {
+			t.Errorf("device %q is registered under %q", device.Name, name)
+		}
+		names = append(names, deviceLabels(device)["drive"])
+	}
+	sort.Strings(names)
+	// The disk both -d variants reach is exported once, not under a suffix
+	if want := []string{"_dev_bus_0_megaraid_0", "_dev_bus_0_megaraid_1"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("getDrives() = %v, want %v", names, want)
+	}
+	if got := testCounterValue(t, deviceSkipped.WithLabelValues("duplicate")); got != before+1 {
+		t.Errorf("smartctl_device_skipped_total{reason=\"duplicate\"} = %v, want %v", got, before+1)
+	}
+}
+
+func TestGetDrivesSameDiskTwoPaths(t *testing.T) {
+	// A multipathed disk, listed under both of its paths
+	info := `{"model_name":"HUC101818CS4200","serial_number":"S2","wwn":{"naa":5,"oui":3274,"id":%d}}`
+	useRunners(t, fakeRunner{
+		"--scan-open --json=c": `{"devices":[
+			{"name":"/dev/sda","type":"scsi"},
+			{"name":"/dev/sdb","type":"scsi"},
+			{"name":"/dev/sdc","type":"scsi"}]}`,
+		strings.Join(collectCommandArgs("scsi", "/dev/sda", "scsi"), " "): fmt.Sprintf(info, 1),
+		strings.Join(collectCommandArgs("scsi", "/dev/sdb", "scsi"), " "): fmt.Sprintf(info, 1),
+		// Same serial, but a WWN telling it apart
+		strings.Join(collectCommandArgs("scsi", "/dev/sdc", "scsi"), " "): fmt.Sprintf(info, 2),
+	}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{}
+	t.Cleanup(func() { devices = savedDevices })
+
+	var names []string
+	for name := range getDrives() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"/dev/sda", "/dev/sdc"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("getDrives() = %v, want %v", names, want)
+	}
+}
+
+func TestDiscoveryReusesCollectCall(t *testing.T) {
+	const dev = "/dev/sda"
+	output := `{"model_name":"ST4000NM0035","serial_number":"ZC1","smart_status":{"passed":true},"temperature":{"current":35},"ata_smart_attributes":{"table":[]}}`
+	savedDevices, savedArgs := devices, collectArgs["sat"]
+	t.Cleanup(func() { devices, collectArgs["sat"] = savedDevices, savedArgs })
+
+	tests := []struct {
+		name     string
+		template string
+		want     map[string]int
+	}{
+		{"template with -i", savedArgs, map[string]int{
+			"-i -A -H -d sat --json=c " + dev: 1,
+		}},
+		{"template without -i", "-A -H -d {type} --json=c {device}", map[string]int{
+			"-i --json=c " + dev:           1,
+			"-A -H -d sat --json=c " + dev: 1,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collectArgs["sat"] = tt.template
+			runner := &countingRunner{fakeRunner: fakeRunner{
+				"--scan-open --json=c": `{"devices":[{"name":"/dev/sda","type":"sat"}]}`,
+				"-i --json=c " + dev:   output,
+				strings.Join(collectCommandArgs("sat", dev, "sat"), " "): output,
+			}, calls: map[string]int{}}
+			useRunners(t, runner, nil)
+			devices = map[string]*Device{}
+
+			devices = getDrives()
+			if device := devices[dev]; device == nil || device.SerialNumber != "ZC1" {
+				t.Fatalf("getDrives() = %v, want %s identified", devices, dev)
+			}
+			collect()
+			delete(runner.calls, "--scan-open --json=c")
+			if fmt.Sprint(runner.calls) != fmt.Sprint(tt.want) {
+				t.Errorf("smartctl calls = %v, want %v", runner.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDrivesNvmeNamespaces(t *testing.T) {
+	info := `{"device":{"protocol":"NVMe"},"model_name":"Samsung SSD 980","serial_number":"%s"}`
+	scan := `{"devices":[
+		{"name":"/dev/nvme0n1","type":"nvme"},
+		{"name":"/dev/nvme0n2","type":"nvme"},
+		{"name":"/dev/nvme1n1","type":"nvme","open_error":"/dev/nvme1n1: Unable to open"},
+		{"name":"/dev/nvme1n2","type":"nvme"}]}`
+	runner := fakeRunner{"--scan-open --json=c": scan}
+	for _, dev := range []string{"/dev/nvme0", "/dev/nvme0n1", "/dev/nvme0n2", "/dev/nvme1n2"} {
+		runner[strings.Join(collectCommandArgs("nvme", dev, "nvme"), " ")] = fmt.Sprintf(info, nvmeController(dev))
+	}
+	useRunners(t, runner, nil)
+	savedDevices, savedExclude, savedStatic := devices, excludeDevices, staticDevices
+	t.Cleanup(func() { devices, excludeDevices, staticDevices = savedDevices, savedExclude, savedStatic })
+
+	exclude, err := parseDevicePattern("/dev/nvme0n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		exclude []devicePattern
+		static  []scanEntry
+		want    []string
+	}{
+		// An excluded or unopenable namespace doesn't take the controller's slot
+		{"scanned", []devicePattern{exclude}, nil, []string{"/dev/nvme0n2", "/dev/nvme1n2"}},
+		{"first namespace", nil, nil, []string{"/dev/nvme0n1", "/dev/nvme1n2"}},
+		// The controller given with --device covers its scanned namespaces
+		{"static controller", nil, []scanEntry{{Name: "/dev/nvme0", Type: "nvme"}}, []string{"/dev/nvme0", "/dev/nvme1n2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices = map[string]*Device{}
+			excludeDevices = tt.exclude
+			staticDevices = tt.static
+
+			disks := getDrives()
+			var names []string
+			for name := range disks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if strings.Join(names, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("getDrives() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+// readFixture returns the parsed JSON of a file in testdata.
+func readFixture(t *testing.T, name string) map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return result
+}
+
+func TestParseAttributesNestedArrays(t *testing.T) {
+	attributes := make(map[string]float64)
+	parseAttributes("", readFixture(t, "nested_arrays.json"), attributes)
+
+	want := map[string]float64{
+		"nvme_smart_health_information_log_temperature":           36,
+		"nvme_smart_health_information_log_temperature_sensors_0": 36,
+		"nvme_smart_health_information_log_temperature_sensors_1": 41,
+		"nvme_self_test_log_table_0_self_test_code_value":         1,
+		"nvme_self_test_log_table_0_self_test_result_value":       0,
+		"nvme_self_test_log_table_0_power_on_hours":               1520,
+		"nvme_self_test_log_table_1_self_test_code_value":         2,
+		"nvme_self_test_log_table_1_self_test_result_value":       7,
+		"nvme_self_test_log_table_1_power_on_hours":               1210,
+		"nvme_self_test_log_table_1_segment_0_0_lba":              4096,
+		"nvme_self_test_log_table_1_segment_0_0_passed":           0,
+		"nvme_self_test_log_table_1_segment_1_0_lba":              8192,
+		"nvme_self_test_log_table_1_segment_1_0_passed":           1,
+		"nvme_self_test_log_table_1_segment_1_1":                  3,
+	}
+	for key, value := range want {
+		if got, ok := attributes[key]; !ok || got != value {
+			t.Errorf("%s = %v (present %v), want %v", key, got, ok, value)
+		}
+	}
+	// Strings such as the self-test names aren't numbers, and an empty array
+	// has no elements
+	for key := range attributes {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected attribute %s = %v", key, attributes[key])
+		}
+	}
+}
+
+func TestSmartNvmeLargeCounters(t *testing.T) {
+	const dev = "/dev/nvme0"
+	data, err := os.ReadFile(filepath.Join("testdata", "nvme_large_counters.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useRunners(t, fakeRunner{
+		strings.Join(collectCommandArgs("nvme", dev, "nvme"), " "): string(data),
+	}, nil)
+
+	attrs, _, _ := smartNvme(dev, nil)
+	if attrs == nil {
+		t.Fatal("smartNvme() = nil")
+	}
+	// Multiplied at run time, as in smartNvme, not as exact constants
+	read, written := 9007199254740992.0, 3.402823669209385e38
+	tests := []struct {
+		key  string
+		want float64
+	}{
+		// Above 2^53, the lowest digits are lost
+		{"data_units_read", read},
+		{"nvme_data_read_bytes", read * 512000},
+		// 128-bit values, from the exact decimal string next to the number
+		{"data_units_written", written},
+		{"nvme_data_written_bytes", written * 512000},
+		{"host_reads", 18446744073709551615},
+		{"nvme_host_read_commands", 18446744073709551615},
+		// Only reported as a string
+		{"host_writes", 36893488147419103232},
+		{"nvme_host_write_commands", 36893488147419103232},
+		{"unsafe_shutdowns", 7},
+	}
+	for _, tt := range tests {
+		if got, ok := attrs[tt.key]; !ok || got != tt.want {
+			t.Errorf("%s = %v (present %v), want %v", tt.key, got, ok, tt.want)
+		}
+	}
+	if _, ok := attrs["data_units_written_s"]; ok {
+		t.Error("the decimal string is exported as data_units_written_s")
+	}
+}
+
+func TestAtaErrorsByType(t *testing.T) {
+	const dev = "/dev/sda"
+	data, err := os.ReadFile(filepath.Join("testdata", "ata_xerror.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useRunners(t, fakeRunner{
+		"-l xerror,error -d sat --json=c " + dev: string(data),
+	}, nil)
+
+	attributes := make(map[string]float64)
+	counts := make(map[string]float64)
+	for _, value := range ataErrorsByType(dev, "sat", attributes) {
+		counts[value.Labels["error_type"]] = value.Value
+	}
+
+	want := map[string]float64{
+		"unc":     2,
+		"icrc":    1,
+		"abrt":    2,
+		"idnf":    1,
+		"timeout": 0,
+		"other":   1,
+	}
+	for errType, count := range want {
+		if got, ok := counts[errType]; !ok || got != count {
+			t.Errorf("error_type=%q: got %v (present %v), want %v", errType, got, ok, count)
+		}
+	}
+	for errType, count := range counts {
+		if _, ok := want[errType]; !ok && count != 0 {
+			t.Errorf("error_type=%q: got %v, want 0", errType, count)
+		}
+	}
+	// The log keeps 6 entries of the 27 errors the drive logged
+	if got := attributes["ata_error_log_count"]; got != 27 {
+		t.Errorf("ata_error_log_count = %v, want 27", got)
+	}
+}
+
+func TestCollectControllerBBUTimeout(t *testing.T) {
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	savedDevices, savedCommand, savedTimeout := devices, controllerBBUCommand, smartctlTimeout
+	t.Cleanup(func() {
+		devices, controllerBBUCommand, smartctlTimeout = savedDevices, savedCommand, savedTimeout
+	})
+	devices = map[string]*Device{
+		"/dev/bus/0_megaraid,0": {Name: "/dev/bus/0_megaraid,0", BusDevice: "/dev/bus/0", ControllerID: "megaraid,0"},
+	}
+	smartctlTimeout = 100 * time.Millisecond
+
+	controllerBBUCommand = script("healthy", "echo 1")
+	collectControllerBBU()
+	if got := testGaugeValue(t, controllerBBUStatus.WithLabelValues("/dev/bus/0")); got != 1 {
+		t.Errorf("smartctl_controller_bbu_status = %v, want 1", got)
+	}
+
+	controllerBBUCommand = script("hung", "exec sleep 10")
+	before := testCounterValue(t, controllerBBUTimeouts.WithLabelValues("/dev/bus/0"))
+	start := time.Now()
+	collectControllerBBU()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hung BBU command ran for %s, want it killed after %s", elapsed, smartctlTimeout)
+	}
+	if got := testCounterValue(t, controllerBBUTimeouts.WithLabelValues("/dev/bus/0")); got != before+1 {
+		t.Errorf("smartctl_controller_bbu_timeouts_total = %v, want %v", got, before+1)
+	}
+	if controllerBBUStatus.DeleteLabelValues("/dev/bus/0") {
+		t.Error("smartctl_controller_bbu_status is still set after the command timed out")
+	}
+	if collectionTimeouts.DeleteLabelValues("_dev_bus_0") {
+		t.Error("the BBU timeout counted as a drive timeout")
+	}
+
+	// The controller's last disk is gone
+	devices = map[string]*Device{}
+	collectControllerBBU()
+	if controllerBBUTimeouts.DeleteLabelValues("/dev/bus/0") {
+		t.Error("smartctl_controller_bbu_timeouts_total is still set for a controller without disks")
+	}
+}
+
+func testGaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func testCounterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestCollectRefreshesIdentity(t *testing.T) {
+	sda := &Device{Name: "/dev/sda", BusDevice: "/dev/sda", Type: "sat", ModelName: "ST4000NM0035", SerialNumber: "ZC1", FirmwareVersion: "TN02"}
+	sdb := &Device{Name: "/dev/sdb", BusDevice: "/dev/sdb", Type: "scsi", ModelName: "HUC101818CS4200", FirmwareVersion: "A3C0"}
+	useRunners(t, fakeRunner{
+		strings.Join(collectCommandArgs("sat", "/dev/sda", "sat"), " "): `{"model_name":"ST4000NM0035","serial_number":"ZC1",
+			"firmware_version":"TN03","user_capacity":{"blocks":7814037168,"bytes":4000787030016},"logical_block_size":512,
+			"smart_status":{"passed":true},"ata_smart_attributes":{"table":[]}}`,
+		strings.Join(collectCommandArgs("scsi", "/dev/sdb", "scsi"), " "): `{"scsi_model_name":"HUC101818CS4200","scsi_revision":"A440",
+			"user_capacity":{"blocks":3516328368,"bytes":1800360124416},"logical_block_size":512,"rotation_rate":10000,
+			"local_time":{"time_t":1700000000},"smart_status":{"passed":true},"scsi_grown_defect_list":0,
+			"scsi_transport_protocol":{"name":"SAS (SPL-4)","value":6},"ata_version":{"string":"ACS-3","major_value":2032,"minor_value":109},
+			"interface_speed":{"max":{"sata_value":14,"string":"6.0 Gb/s","units_per_second":60,"bits_per_unit":100000000}}}`,
+	}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{sda.Name: sda, sdb.Name: sdb}
+	t.Cleanup(func() { devices = savedDevices })
+
+	samples, _ := collect()
+	if sda.FirmwareVersion != "TN03" || sda.CapacityBytes != 4000787030016 {
+		t.Errorf("sda identity not refreshed: firmware %q, capacity %d", sda.FirmwareVersion, sda.CapacityBytes)
+	}
+	if sdb.FirmwareVersion != "A440" || sdb.RotationRate == nil || *sdb.RotationRate != 10000 {
+		t.Errorf("sdb identity not refreshed: firmware %q, rotation rate %v", sdb.FirmwareVersion, sdb.RotationRate)
+	}
+	for _, sample := range samples {
+		switch sample.Name {
+		case "smartctl_device_info":
+			if sample.Labels["drive"] == "_dev_sda" && sample.Labels["firmware_version"] != "TN03" {
+				t.Errorf("smartctl_device_info of sda has firmware_version %q, want TN03", sample.Labels["firmware_version"])
+			}
+		// Identity fields of the SCSI output aren't measurements
+		case "smartctl_user_capacity_bytes", "smartctl_logical_block_size", "smartctl_rotation_rate", "smartctl_local_time_time_t":
+			t.Errorf("identity field exported as %s", sample.Name)
+		default:
+			for _, key := range []string{"scsi_transport_protocol", "ata_version", "interface_speed"} {
+				if strings.HasPrefix(sample.Name, "smartctl_"+key) {
+					t.Errorf("identity field exported as %s", sample.Name)
+				}
+			}
+		}
+	}
+}
+
+func TestCollectControllerDiskLabels(t *testing.T) {
+	disk := &Device{Name: "/dev/bus/0_megaraid,5", BusDevice: "/dev/bus/0", Type: "sat+megaraid,5", Controller: "megaraid", ControllerID: "megaraid,5", SerialNumber: "ZC1"}
+	sda := &Device{Name: "/dev/sda", BusDevice: "/dev/sda", Type: "sat", SerialNumber: "ZC2"}
+	health := `{"smart_status":{"passed":true},"temperature":{"current":35}}`
+	useRunners(t, fakeRunner{
+		strings.Join(collectCommandArgs("megaraid", "/dev/bus/0", "megaraid,5"), " "): health,
+		strings.Join(collectCommandArgs("sat", "/dev/sda", "sat"), " "):               health,
+	}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{disk.Name: disk, sda.Name: sda}
+	t.Cleanup(func() { devices = savedDevices })
+
+	samples, _ := collect()
+	want := map[string]prometheus.Labels{
+		"_dev_bus_0_megaraid_5": {"bus_device": "/dev/bus/0", "controller_id": "megaraid,5"},
+		"_dev_sda":              {"bus_device": "", "controller_id": ""},
+	}
+	found := 0
+	for _, sample := range samples {
+		if sample.Name != "smartctl_device_info" {
+			continue
+		}
+		labels, ok := want[sample.Labels["drive"]]
+		if !ok {
+			continue
+		}
+		found++
+		for name, value := range labels {
+			if got, ok := sample.Labels[name]; !ok || got != value {
+				t.Errorf("%s: smartctl_device_info %s = %q, want %q", sample.Labels["drive"], name, got, value)
+			}
+		}
+	}
+	if found != len(want) {
+		t.Errorf("found smartctl_device_info for %d drives, want %d", found, len(want))
+	}
+}
+
+func TestCollectDeferredKeepsSamples(t *testing.T) {
+	sda := &Device{Name: "/dev/sda", BusDevice: "/dev/sda", Type: "sat", ModelName: "ST4000NM0035", SerialNumber: "ZC1"}
+	useRunners(t, fakeRunner{
+		strings.Join(collectCommandArgs("sat", "/dev/sda", "sat"), " "): `{"smart_status":{"passed":true},
+			"ata_smart_attributes":{"table":[{"id":5,"name":"Reallocated_Sector_Ct","value":100,"worst":100,"thresh":10,"raw":{"value":3,"string":"3"}}]}}`,
+	}, nil)
+	savedDevices, savedDeadline := devices, cycleDeadline
+	t.Cleanup(func() {
+		devices, cycleDeadline = savedDevices, savedDeadline
+		deferred = make(map[string]bool)
+		lastSamples = make(map[string][]metricSample)
+	})
+	devices = map[string]*Device{sda.Name: sda}
+	deferred = make(map[string]bool)
+	lastSamples = make(map[string][]metricSample)
+
+	values := func(samples []metricSample) map[string]float64 {
+		found := make(map[string]float64)
+		for _, sample := range samples {
+			if sample.Labels["drive"] == "_dev_sda" {
+				found[sample.Name] = sample.Value
+			}
+		}
+		return found
+	}
+
+	// Before its first collection a deferred device only has device_info
+	cycleDeadline = time.Nanosecond
+	got := values(samplesOf(collect()))
+	if _, ok := got["smartctl_device_info"]; !ok || len(got) != 1 {
+		t.Errorf("deferred before the first collection: got %v, want only smartctl_device_info", got)
+	}
+
+	cycleDeadline = 0
+	collected := values(samplesOf(collect()))
+	if collected["smartctl_device_up"] != 1 || collected["smartctl_reallocated_sector_ct_raw"] != 3 {
+		t.Fatalf("collection: got %v", collected)
+	}
+
+	cycleDeadline = time.Nanosecond
+	got = values(samplesOf(collect()))
+	if !deferred[sda.Name] {
+		t.Fatal("device wasn't deferred")
+	}
+	if len(got) != len(collected) {
+		t.Errorf("deferred cycle exported %d series, want the %d of the last collection: %v", len(got), len(collected), got)
+	}
+	for name, value := range collected {
+		if got[name] != value {
+			t.Errorf("deferred cycle: %s = %v, want %v", name, got[name], value)
+		}
+	}
+}
+
+// samplesOf returns the samples of collect, dropping whether it completed.
+func samplesOf(samples []metricSample, _ bool) []metricSample {
+	return samples
+}
+
+func TestSmartPassedNeedsHealth(t *testing.T) {
+	savedArgs := map[string]string{"sat": collectArgs["sat"], "nvme": collectArgs["nvme"]}
+	t.Cleanup(func() {
+		for class, args := range savedArgs {
+			collectArgs[class] = args
+		}
+	})
+	// Templates without -H
+	collectArgs["sat"] = "-A -d {type} --json=c {device}"
+	collectArgs["nvme"] = "-A -d nvme --json=c {device}"
+	useRunners(t, fakeRunner{
+		"-A -d sat --json=c /dev/sda":    `{"ata_smart_attributes":{"table":[{"id":5,"name":"Reallocated_Sector_Ct","value":100,"raw":{"value":0,"string":"0"}}]}}`,
+		"-A -d nvme --json=c /dev/nvme0": `{"nvme_smart_health_information_log":{"media_errors":0}}`,
+	}, nil)
+
+	sat, _, _ := smartSat("/dev/sda", "sat", nil)
+	nvme, _, _ := smartNvme("/dev/nvme0", nil)
+	for name, attrs := range map[string]map[string]float64{"sat": sat, "nvme": nvme} {
+		if attrs == nil {
+			t.Errorf("%s: no attributes", name)
+		}
+		if passed, ok := attrs["smart_passed"]; ok {
+			t.Errorf("%s: smart_passed = %v without smart_status, want it unset", name, passed)
+		}
+	}
+}
+
+func TestAtaErrorsByTypeSummaryLog(t *testing.T) {
+	const dev = "/dev/sda"
+	// A drive without the comprehensive error log
+	useRunners(t, fakeRunner{
+		"-l xerror,error -d sat --json=c " + dev: `{"ata_smart_error_log":{"summary":{"revision":1,"count":3,"logged_count":2,"table":[
+			{"error_number":3,"lifetime_hours":5120,"error_description":"Error: UNC at LBA = 0x00000a00 = 2560"},
+			{"error_number":2,"lifetime_hours":5119,"error_description":"Error: ICRC, ABRT at LBA = 0x00000000 = 0"}]}}}`,
+	}, nil)
+
+	attributes := make(map[string]float64)
+	counts := make(map[string]float64)
+	for _, value := range ataErrorsByType(dev, "sat", attributes) {
+		counts[value.Labels["error_type"]] = value.Value
+	}
+	for errType, want := range map[string]float64{"unc": 1, "icrc": 1, "abrt": 1, "other": 0} {
+		if got := counts[errType]; got != want {
+			t.Errorf("error_type=%q: got %v, want %v", errType, got, want)
+		}
+	}
+	if got := attributes["ata_error_log_count"]; got != 3 {
+		t.Errorf("ata_error_log_count = %v, want 3", got)
+	}
+}
+
+func TestApplyWorstOver(t *testing.T) {
+	savedWindow, savedHistory := reportWorstOver, history
+	t.Cleanup(func() { reportWorstOver, history = savedWindow, savedHistory })
+	reportWorstOver = 3
+	history = make(map[string]map[string][]float64)
+
+	cycles := []map[string]float64{
+		{"ata_current_pending_sectors": 8, "temperature_celsius": 48, "Reallocated_Sector_Ct": 90, "Reallocated_Sector_Ct_raw": 12, "Reallocated_Sector_Ct_threshold": 10, "smart_passed": 0},
+		{"ata_current_pending_sectors": 0, "temperature_celsius": 40, "Reallocated_Sector_Ct": 100, "Reallocated_Sector_Ct_raw": 0, "Reallocated_Sector_Ct_threshold": 5, "smart_passed": 1},
+	}
+	var attrs map[string]float64
+	for _, cycle := range cycles {
+		attrs = cycle
+		applyWorstOver("/dev/sda", attrs)
+	}
+	want := map[string]float64{
+		"ata_current_pending_sectors":     8,
+		"temperature_celsius":             48,
+		"Reallocated_Sector_Ct":           90,
+		"Reallocated_Sector_Ct_raw":       12,
+		"Reallocated_Sector_Ct_threshold": 5,
+		"smart_passed":                    0,
+	}
+	for key, value := range want {
+		if got := attrs[key]; got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestCollectDuplicateNamesStable(t *testing.T) {
+	sdb := &Device{Name: "/dev/sdb", BusDevice: "/dev/sdb", Type: "scsi"}
+	// Both keys sanitize to smartctl_vendor_counter
+	useRunners(t, fakeRunner{
+		strings.Join(collectCommandArgs("scsi", "/dev/sdb", "scsi"), " "): `{"smart_status":{"passed":true},
+			"temperature":{"current":30},"vendor_counter":1,"Vendor-Counter":2}`,
+	}, nil)
+	savedDevices := devices
+	devices = map[string]*Device{sdb.Name: sdb}
+	t.Cleanup(func() { devices = savedDevices })
+
+	for i := 0; i < 20; i++ {
+		samples, _ := collect()
+		found := false
+		for _, sample := range samples {
+			if sample.Name == "smartctl_vendor_counter" {
+				// "Vendor-Counter" sorts first
+				if sample.Value != 2 {
+					t.Fatalf("cycle %d: the first smartctl_vendor_counter is %v, want 2", i, sample.Value)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("cycle %d: no smartctl_vendor_counter", i)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// staticDevices are the --device entries, probed whether or not the device
+// scan lists them.
+var staticDevices []scanEntry
+
+// parseStaticDevice parses a --device value of the form path:type, such as
+// /dev/sdb:sat or /dev/bus/0:megaraid,5.
+func parseStaticDevice(value string) (scanEntry, error) {
+	name, typ, ok := strings.Cut(value, ":")
+	if !ok || name == "" || typ == "" {
+		return scanEntry{}, fmt.Errorf("invalid --device %q, expected path:type", value)
+	}
+	return scanEntry{Name: name, Type: typ}, nil
+}
+
+// overriddenByStatic reports whether a scanned device is also given with
+// --device, whose type then wins. Drives behind a RAID controller share the
+// bus device and are told apart by their controller target.
+func overriddenByStatic(device scanEntry) bool {
+	for _, static := range staticDevices {
+		_, staticID := controllerDeviceID(static.Type)
+		_, scannedID := controllerDeviceID(device.Type)
+		if static.Name == device.Name && staticID == scannedID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import "strings"
+
+// metricUnits maps metrics whose name doesn't say what unit they are in to the
+// unit suffix the Prometheus naming conventions ask for, keyed by the metric
+// name without the smartctl_ prefix. ATA attributes are left alone, their
+// normalized values have no unit. The NVMe composite temperature keeps its
+// name, smartctl_temperature_celsius is ATA attribute 194; it is exported in
+// Celsius as device_temperature_celsius.
+var metricUnits = map[string]string{
+	// NVMe health log, see minuteAttributes
+	"controller_busy_time": "seconds",
+	"warning_temp_time":    "seconds",
+	"critical_comp_time":   "seconds",
+
+	// SCSI temperature log
+	"temperature_current":      "celsius",
+	"temperature_drive_trip":   "celsius",
+	"temperature_lifetime_min": "celsius",
+	"temperature_lifetime_max": "celsius",
+	"temperature_op_limit_max": "celsius",
+}
+
+// NVMe health log fields smartctl reports in minutes. They are converted to
+// seconds, the base unit.
+var minuteAttributes = []string{"controller_busy_time", "warning_temp_time", "critical_comp_time"}
+
+// minutesToSeconds converts the minuteAttributes of a drive in place.
+func minutesToSeconds(attributes map[string]float64) {
+	for _, key := range minuteAttributes {
+		if value, ok := attributes[key]; ok {
+			attributes[key] = value * 60
+		}
+	}
+}
+
+// withUnit appends the unit suffix to a sanitized attribute name, unless the
+// unit isn't known or the name already ends with it.
+func withUnit(name string) string {
+	unit, ok := metricUnits[name]
+	if !ok || strings.HasSuffix(name, "_"+unit) {
+		return name
+	}
+	return name + "_" + unit
+}
+
+// attributeMetricName returns the metric name for an attribute key, or "" when
+// nothing of the key is usable in a metric name.
+func attributeMetricName(key string) string {
+	name := sanitizeMetricName(key)
+	if name == "" {
+		return ""
+	}
+	return "smartctl_" + withUnit(name)
+}
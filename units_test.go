@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestWithUnit(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		// Would collide with ATA attribute 194
+		{"temperature", "temperature"},
+		{"temperature_current", "temperature_current_celsius"},
+		{"temperature_lifetime_max", "temperature_lifetime_max_celsius"},
+		{"controller_busy_time", "controller_busy_time_seconds"},
+		// Already suffixed, no second unit
+		{"temperature_celsius", "temperature_celsius"},
+		{"device_temperature_celsius", "device_temperature_celsius"},
+		// Unknown unit
+		{"available_spare", "available_spare"},
+	}
+	for _, tt := range tests {
+		if got := withUnit(tt.name); got != tt.want {
+			t.Errorf("withUnit(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A unit table entry whose name carries the suffix itself
+	metricUnits["drive_trip_celsius"] = "celsius"
+	defer delete(metricUnits, "drive_trip_celsius")
+	if got := withUnit("drive_trip_celsius"); got != "drive_trip_celsius" {
+		t.Errorf("withUnit(%q) = %q, want %q", "drive_trip_celsius", got, "drive_trip_celsius")
+	}
+}
+
+func TestAttributeMetricNameUnits(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"temperature", "smartctl_temperature"},
+		{"temperature_current", "smartctl_temperature_current_celsius"},
+		{"warning_temp_time", "smartctl_warning_temp_time_seconds"},
+		// ATA attributes keep their names, even when they end in the unit
+		{"Temperature_Celsius", "smartctl_temperature_celsius"},
+		{"Airflow_Temperature_Cel", "smartctl_airflow_temperature_cel"},
+	}
+	for _, tt := range tests {
+		if got := attributeMetricName(tt.key); got != tt.want {
+			t.Errorf("attributeMetricName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMinutesToSeconds(t *testing.T) {
+	attributes := map[string]float64{"controller_busy_time": 90, "critical_comp_time": 0, "power_on_hours": 5}
+	minutesToSeconds(attributes)
+	want := map[string]float64{"controller_busy_time": 5400, "critical_comp_time": 0, "power_on_hours": 5}
+	for key, value := range want {
+		if got := attributes[key]; got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
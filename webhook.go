@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event is the JSON body POSTed to --event-webhook-url.
+type event struct {
+	Device       string    `json:"device"`
+	SerialNumber string    `json:"serial_number"`
+	ModelName    string    `json:"model_name"`
+	Attribute    string    `json:"attribute"`
+	OldValue     float64   `json:"old_value"`
+	NewValue     float64   `json:"new_value"`
+	Threshold    *float64  `json:"threshold,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+var (
+	eventWebhookURL string
+	eventDebounce   = 5 * time.Minute
+	// Watched attributes by sanitized name (without the smartctl_ prefix)
+	eventWatches = make(map[string]float64)
+	// Last value of each watched attribute per drive
+	eventState = make(map[string]map[string]float64)
+	// When an event was last sent, per drive and eventKey
+	eventSent = make(map[string]map[string]time.Time)
+
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// parseEventWatch parses an --event-watch value of the form name=threshold.
+func parseEventWatch(value string) (string, float64, error) {
+	name, threshold, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return "", 0, fmt.Errorf("invalid --event-watch %q, expected name=threshold", value)
+	}
+	t, err := strconv.ParseFloat(threshold, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid --event-watch threshold in %q: %v", value, err)
+	}
+	// Attributes are compared by their name with the unit suffix, accept
+	// both "temperature" and "temperature_celsius"
+	return withUnit(sanitizeMetricName(name)), t, nil
+}
+
+// checkEvents compares this cycle's attributes against the previous cycle and
+// sends an event for every health change or watched threshold crossing.
+func checkEvents(device *Device, attrs map[string]float64) {
+	drive := device.Name
+	previous, seen := eventState[drive]
+	current := make(map[string]float64)
+	eventState[drive] = current
+
+	for key, value := range attrs {
+		name := withUnit(sanitizeMetricName(key))
+		threshold, watched := eventWatches[name]
+		if !watched && name != "smart_passed" {
+			continue
+		}
+		current[name] = value
+
+		old, ok := previous[name]
+		if !seen || !ok {
+			continue
+		}
+		if watched && (old > threshold) != (value > threshold) {
+			t := threshold
+			sendEvent(device, name, old, value, &t)
+		} else if !watched && old != value {
+			sendEvent(device, name, old, value, nil)
+		}
+	}
+}
+
+// sendEvent POSTs the event in the background unless an identical one was sent
+// within --event-debounce.
+func sendEvent(device *Device, attribute string, oldValue, newValue float64, threshold *float64) {
+	sent, ok := eventSent[device.Name]
+	if !ok {
+		sent = make(map[string]time.Time)
+		eventSent[device.Name] = sent
+	}
+	key := eventKey(attribute, newValue, threshold)
+	if last, ok := sent[key]; ok && time.Since(last) < eventDebounce {
+		return
+	}
+	sent[key] = time.Now()
+
+	body, err := json.Marshal(event{
+		Device:       device.Name,
+		SerialNumber: device.SerialNumber,
+		ModelName:    device.ModelName,
+		Attribute:    attribute,
+		OldValue:     oldValue,
+		NewValue:     newValue,
+		Threshold:    threshold,
+		Timestamp:    time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Error("Error encoding event", "err", err)
+		return
+	}
+
+	go func() {
+		resp, err := webhookClient.Post(eventWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("Error sending event", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("Event webhook returned an error status", "status", resp.Status)
+		}
+	}()
+}
+
+// eventKey identifies identical events of a drive: a watched attribute
+// crossing its threshold in the same direction, or smart_passed changing to
+// the same value. There are at most two per attribute.
+func eventKey(attribute string, newValue float64, threshold *float64) string {
+	if threshold != nil {
+		return fmt.Sprintf("%s|%t", attribute, newValue > *threshold)
+	}
+	return fmt.Sprintf("%s|%v", attribute, newValue)
+}
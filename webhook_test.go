@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseEventWatchUnits(t *testing.T) {
+	for _, value := range []string{"temperature_current=55", "temperature_current_celsius=55", "Temperature_Current=55"} {
+		name, threshold, err := parseEventWatch(value)
+		if err != nil {
+			t.Fatalf("parseEventWatch(%q): %v", value, err)
+		}
+		if name != "temperature_current_celsius" || threshold != 55 {
+			t.Errorf("parseEventWatch(%q) = %q, %v, want temperature_current_celsius, 55", value, name, threshold)
+		}
+	}
+}
+
+func TestCheckEvents(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	savedURL, savedWatches := eventWebhookURL, eventWatches
+	t.Cleanup(func() {
+		eventWebhookURL, eventWatches = savedURL, savedWatches
+		eventState = make(map[string]map[string]float64)
+		eventSent = make(map[string]map[string]time.Time)
+	})
+	eventWebhookURL = server.URL
+	name, threshold, _ := parseEventWatch("device_temperature_celsius=55")
+	eventWatches = map[string]float64{name: threshold}
+
+	device := &Device{Name: "/dev/nvme0"}
+	for _, temp := range []float64{50, 56, 50, 56, 57} {
+		checkEvents(device, map[string]float64{"device_temperature_celsius": temp})
+	}
+	// Up and down, then up again within the debounce, which is dropped
+	if got := len(eventSent[device.Name]); got != 2 {
+		t.Errorf("eventSent has %d entries for the drive, want one per crossing direction: %v", got, eventSent[device.Name])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(bodies)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Errorf("webhook received %d events, want 2: %v", len(bodies), bodies)
+	}
+}
+
+func TestRescanForgetsEvents(t *testing.T) {
+	useRunners(t, fakeRunner{"--scan-open --json=c": `{"devices":[]}`}, nil)
+	savedDevices := devices
+	t.Cleanup(func() {
+		devices = savedDevices
+		eventSent = make(map[string]map[string]time.Time)
+	})
+	devices = map[string]*Device{"/dev/sda": {Name: "/dev/sda", BusDevice: "/dev/sda", Type: "sat"}}
+	eventSent = map[string]map[string]time.Time{"/dev/sda": {"smart_passed|0": time.Now()}}
+
+	if _, removed := rescan(); removed != 1 {
+		t.Fatalf("rescan() removed %d devices, want 1", removed)
+	}
+	if _, ok := eventSent["/dev/sda"]; ok {
+		t.Error("eventSent still has the removed drive")
+	}
+}